@@ -0,0 +1,128 @@
+// This source code is covered by the license found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// afPacketPollTimeout is how long an AF_PACKET socket waits for a packet before returning a
+// timeout, which gives its reader a chance to stop.
+const afPacketPollTimeout = 100 * time.Millisecond
+
+// afPacket is a PacketSource that reads from the TPACKET_V3 ring of an AF_PACKET socket.
+type afPacket struct {
+	*afpacket.TPacket
+}
+
+// maxFanoutGroupTries is how many random fanout group IDs openAFPacket tries before giving up.
+const maxFanoutGroupTries = 16
+
+// fanoutGroups picks fanout group IDs.
+var fanoutGroups = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// openAFPacket opens config.AFPacketFanout AF_PACKET sockets on a device.  Several sockets join a
+// fanout group that hashes packets by their addresses and ports, so both directions of a flow go
+// to the same socket.  Each socket keeps only the first config.SnapLen bytes of a packet.
+func openAFPacket(name string) ([]PacketSource, error) {
+	if config.AFPacketFanout < 1 {
+		config.AFPacketFanout = 1
+	}
+	// A BPF program's return value is the number of bytes to keep, so an accept-all filter
+	// applies the snap length until SetBPFFilter replaces it.
+	snap, err := bpf.RetConstant{Val: uint32(config.SnapLen)}.Assemble()
+	if err != nil {
+		return nil, err
+	}
+	var group uint16
+	var sources []PacketSource
+	for i := uint(0); i < config.AFPacketFanout; i++ {
+		handle, err := afpacket.NewTPacket(
+			afpacket.OptInterface(name),
+			afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+			afpacket.OptBlockSize(int(config.AFPacketBlockSize)*1024),
+			afpacket.OptNumBlocks(int(config.AFPacketBlocks)),
+			afpacket.OptPollTimeout(afPacketPollTimeout),
+			// The kernel strips VLAN tags, and we want them in flow keys.
+			afpacket.OptAddVLANHeader(true))
+		if err == nil {
+			err = handle.SetBPF([]bpf.RawInstruction{snap})
+			if err == nil && config.AFPacketFanout > 1 {
+				group, err = joinFanout(handle, group, i == 0)
+			}
+			if err != nil {
+				handle.Close()
+			}
+		}
+		if err != nil {
+			for _, source := range sources {
+				source.Close()
+			}
+			return nil, err
+		}
+		sources = append(sources, afPacket{handle})
+	}
+	return sources, nil
+}
+
+// joinFanout adds a socket to a fanout group and returns the group's ID.  The first socket of a
+// device starts a group with a random ID.  Group IDs are shared by all processes and devices of
+// the network namespace, and joining a group on another device fails, so it tries other IDs
+// until it finds a free one.  A group of another ing on the same device would still be joined,
+// but with a random ID that is unlikely.
+func joinFanout(handle *afpacket.TPacket, group uint16, first bool) (uint16, error) {
+	if !first {
+		// Defragmenting makes all fragments of a packet hash like its first one.
+		return group, handle.SetFanout(afpacket.FanoutHashWithDefrag, group)
+	}
+	var err error
+	for try := 0; try < maxFanoutGroupTries; try++ {
+		group = uint16(fanoutGroups.Intn(math.MaxUint16 + 1))
+		if err = handle.SetFanout(afpacket.FanoutHashWithDefrag, group); err != syscall.EINVAL &&
+			err != syscall.EADDRINUSE {
+			return group, err
+		}
+	}
+	return 0, fmt.Errorf("no free AF_PACKET fanout group after %d tries: %v", maxFanoutGroupTries,
+		err)
+}
+
+// LinkType returns Ethernet, the link type of AF_PACKET raw sockets on Ethernet devices.
+func (a afPacket) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+// SetBPFFilter compiles a filter with libpcap and attaches it to the socket.  Like the filter it
+// replaces, it keeps config.SnapLen bytes of each packet.
+func (a afPacket) SetBPFFilter(expr string) error {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, config.SnapLen, expr)
+	if err != nil {
+		return err
+	}
+	filter := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		filter[i] = bpf.RawInstruction{Op: ins.Code, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+	return a.SetBPF(filter)
+}
+
+// captureStats returns the packets received and dropped by the socket.  AF_PACKET doesn't know
+// about drops by the interface.
+func (a afPacket) captureStats() (CaptureStats, error) {
+	_, v3, err := a.SocketStats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	return CaptureStats{Received: uint64(v3.Packets()), Dropped: uint64(v3.Drops())}, nil
+}
@@ -0,0 +1,140 @@
+// This source code is covered by the license found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// Testing
+
+func TestAFPacketFanout(t *testing.T) {
+	config.AFPacket, config.AFPacketBlockSize, config.AFPacketBlocks = true, 64, 4
+	config.AFPacketFanout = 2
+	defer func() { config.AFPacket, config.AFPacketFanout = false, 1 }()
+
+	devices, err := OpenDevices([]string{"lo"})
+	if os.IsPermission(err) {
+		t.Skip("AF_PACKET sockets need CAP_NET_RAW:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer devices.Close()
+	if len(devices.sources) != 2 {
+		t.Fatalf("got %d sockets, want 2", len(devices.sources))
+	}
+	if shards := devices.Shards(); len(shards) != 2 {
+		t.Fatalf("got %d shards, want 2", len(shards))
+	}
+	if err := devices.SetBPFFilter("udp port 47808"); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp", "127.0.0.1:47808")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	payload := []byte("ing afpacket test")
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.Write(payload)
+		data, ci, err := devices.ZeroCopyReadPacketData()
+		if err != nil {
+			continue
+		}
+		if bytes.Contains(data, payload) {
+			if iface, _ := devices.Interface(ci.InterfaceIndex); iface.Name != "lo" {
+				t.Errorf("got interface %q, want lo", iface.Name)
+			}
+			if stats, err := devices.CaptureStats(); err != nil {
+				t.Error(err)
+			} else if len(stats) != 1 || stats[0].Device != "lo" || stats[0].Received == 0 {
+				t.Errorf("got capture stats %v, want received packets on lo", stats)
+			}
+			return
+		}
+	}
+	t.Error("did not capture the test packet")
+}
+
+func TestAFPacketFanoutDevices(t *testing.T) {
+	config.AFPacket, config.AFPacketBlockSize, config.AFPacketBlocks = true, 64, 4
+	config.AFPacketFanout = 2
+	defer func() { config.AFPacket, config.AFPacketFanout = false, 1 }()
+
+	// Each device needs a fanout group of its own.
+	names := []string{"lo"}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Name != "lo" && iface.Flags&net.FlagUp != 0 {
+			names = append(names, iface.Name)
+			break
+		}
+	}
+	if len(names) < 2 {
+		t.Skip("no device besides lo")
+	}
+	devices, err := OpenDevices(names)
+	if os.IsPermission(err) {
+		t.Skip("AF_PACKET sockets need CAP_NET_RAW:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer devices.Close()
+	shards := devices.Shards()
+	if len(shards) != 2 {
+		t.Fatalf("got %d shards, want 2", len(shards))
+	}
+	for i, shard := range shards {
+		for j, name := range names {
+			if iface, _ := shard.(*Devices).Interface(j); iface.Name != name {
+				t.Errorf("shard %d has interface %q at %d, want %q", i, iface.Name, j, name)
+			}
+		}
+	}
+}
+
+func TestAFPacketSnapLen(t *testing.T) {
+	config.AFPacket, config.AFPacketBlockSize, config.AFPacketBlocks = true, 64, 4
+	config.SnapLen = 64
+	defer func() { config.AFPacket, config.SnapLen = false, 65536 }()
+
+	devices, err := OpenDevices([]string{"lo"})
+	if os.IsPermission(err) {
+		t.Skip("AF_PACKET sockets need CAP_NET_RAW:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer devices.Close()
+
+	conn, err := net.Dial("udp", "127.0.0.1:47809")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	payload := bytes.Repeat([]byte("ing snaplen test "), 20)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.Write(payload)
+		data, ci, err := devices.ZeroCopyReadPacketData()
+		if err != nil || ci.Length != 14+20+8+len(payload) {
+			continue
+		}
+		if len(data) != 64 || ci.CaptureLength != 64 {
+			t.Errorf("got %d bytes (capture length %d) of a %d byte packet, want 64", len(data),
+				ci.CaptureLength, ci.Length)
+		}
+		return
+	}
+	t.Error("did not capture the test packet")
+}
@@ -0,0 +1,12 @@
+// This source code is covered by the license found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import "errors"
+
+// openAFPacket would open AF_PACKET sockets on a device, but they only exist on Linux.
+func openAFPacket(name string) ([]PacketSource, error) {
+	return nil, errors.New("AF_PACKET capture is only supported on Linux")
+}
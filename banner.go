@@ -15,12 +15,13 @@ import (
 
 // FirstPayload ...
 type FirstPayload struct {
-	IP      IPAddress // IP address of the banner
-	FlowID  uint64
-	Sport   uint16
-	Dport   uint16
-	Seen    time.Time // Time the banner was seen
-	Payload [192]byte // Payload  (TODO: Pick a smart size for this array; 192 is a swag.)
+	IP          IPAddress // IP address of the banner
+	FlowID      uint64
+	CommunityID string // Community ID of the flow
+	Sport       uint16
+	Dport       uint16
+	Seen        time.Time // Time the banner was seen
+	Payload     [192]byte // Payload  (TODO: Pick a smart size for this array; 192 is a swag.)
 }
 
 // BannerTerm represents a search term for extracting banners from payloads.
@@ -37,13 +38,14 @@ type BannerTerm struct {
 
 // Banner ...
 type Banner struct {
-	IP      IPAddress
-	Seen    time.Time
-	Port    uint16
-	IANATag string
-	Type    string // "client" or "server"
-	FlowID  uint64
-	Banner  string
+	IP          IPAddress
+	Seen        time.Time
+	Port        uint16
+	IANATag     string
+	Type        string // "client" or "server"
+	FlowID      uint64
+	CommunityID string
+	Banner      string
 }
 
 func (b Banner) String() string {
@@ -123,6 +125,7 @@ func ExtractBanners(done <-chan struct{}, in <-chan FirstPayload) <-chan Banner
 					// Question: Can we have more than one hit in a banner? If so, is it an error?
 					b.IP = fp.IP
 					b.FlowID = fp.FlowID
+					b.CommunityID = fp.CommunityID
 					b.Seen = fp.Seen
 					b.IANATag = terms[hits[i]].IANATag
 					b.Type = terms[hits[i]].Type
@@ -27,29 +27,46 @@ func WriteBanners(done <-chan struct{}, in <-chan Banner) {
 		}
 		filename := config.OutputPrefix + "banner" + config.OutputSlug + ".json"
 		l := &lumberjack.Logger{Filename: filename, MaxSize: 100, MaxAge: 1}
-		ticker := time.NewTicker(time.Duration(config.OutputRotationInterval) * time.Minute).C
+		rotation := rotation{interval: time.Duration(config.OutputRotationInterval) * time.Minute}
+		// With output windows, banners go to the file of the window they were seen in instead.
+		var windows *WindowWriter
+		if config.OutputWindow > 0 {
+			windows = NewWindowWriter(config.OutputPrefix+"banner"+config.OutputSlug, ".json",
+				time.Duration(config.OutputWindow)*time.Minute)
+		}
 
 	Loop:
 		for b := range in {
 			select {
 			case <-done:
 				break Loop
-			case <-ticker:
-				l.Rotate() // Rotate the log file every five minutes.
 			default:
-				bn, err := json.Marshal(b)
-				if err != nil {
-					// TODO: Better error handling here.
-					log.Println("Cannot convert flow to JSON: ", b.String()) // Could go to lumberjack error log
-					continue
+			}
+			if windows == nil && rotation.due() {
+				l.Rotate() // Rotate the log file based on `config.OutputRotationInterval`.
+			}
+			bn, err := json.Marshal(b)
+			if err != nil {
+				// TODO: Better error handling here.
+				log.Println("Cannot convert flow to JSON: ", b.String()) // Could go to lumberjack error log
+				continue
+			}
+			if windows != nil {
+				if err = windows.Write(b.Seen, bn); err != nil {
+					log.Println("Cannot write banner: ", err)
 				}
-				l.Write(bn)
+				continue
 			}
+			l.Write(bn)
+		}
+		if windows != nil {
+			windows.Close()
+		} else {
+			// Force a timestamp on the last rotated file and delete the resulting empty flow.json file.
+			l.Rotate()
+			os.Remove(filename)
+			l.Close()
 		}
-		// Force a timestamp on the last rotated file and delete the resulting empty flow.json file.
-		l.Rotate()
-		os.Remove(filename)
-		l.Close()
 		wg.Done()
 	}()
 }
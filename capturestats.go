@@ -0,0 +1,117 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+)
+
+// CaptureStats are the packet counts of a live device since it was opened.
+type CaptureStats struct {
+	Device    string
+	Received  uint64 // Packets received by the capture
+	Dropped   uint64 // Packets dropped by the kernel because the capture buffer was full
+	IfDropped uint64 // Packets dropped by the network interface or its driver
+}
+
+// statsSource is a PacketSource that reports the capture statistics of its devices.  Offline
+// captures have none.
+type statsSource interface {
+	CaptureStats() ([]CaptureStats, error)
+}
+
+// StatsRecord is a record of the stats output files.
+type StatsRecord struct {
+	Time    time.Time
+	Final   bool // The record at the end of the run
+	Devices []CaptureStats
+}
+
+// WriteCaptureStats reports the capture statistics of a source every config.StatsInterval
+// minutes and once more when done is closed, to the console and to the stats output files.  The
+// returned channel is closed after the final report.  Counts are totals since the start of the
+// capture.
+func WriteCaptureStats(done <-chan struct{}, source statsSource) <-chan struct{} {
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		var l *lumberjack.Logger
+		var filename string
+		if !config.Debug.DropOutput {
+			if err := os.MkdirAll(config.OutputPrefix, 0700); err != nil {
+				log.Println("[Warning] Cannot create directory '", config.OutputPrefix, "'. Not writing stats.")
+			} else {
+				if config.OutputPrefix[len(config.OutputPrefix)-1] != '/' {
+					config.OutputPrefix = config.OutputPrefix + "/"
+				}
+				filename = config.OutputPrefix + "stats" + config.OutputSlug + ".json"
+				l = &lumberjack.Logger{Filename: filename, MaxSize: 100, MaxAge: 1}
+			}
+		}
+		rotation := rotation{interval: time.Duration(config.OutputRotationInterval) * time.Minute}
+		var tick <-chan time.Time
+		if config.StatsInterval > 0 {
+			ticker := time.NewTicker(time.Duration(config.StatsInterval) * time.Minute)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		report := func(final bool) {
+			devices, err := source.CaptureStats()
+			if err != nil {
+				log.Println("Cannot get capture stats: ", err)
+				return
+			}
+			printCaptureStats(devices, final)
+			if l == nil {
+				return
+			}
+			if rotation.due() {
+				l.Rotate() // Rotate the log file based on `config.OutputRotationInterval`.
+			}
+			b, err := json.Marshal(StatsRecord{Time: time.Now(), Final: final, Devices: devices})
+			if err != nil {
+				log.Println("Cannot convert capture stats to JSON: ", err)
+				return
+			}
+			l.Write(b)
+		}
+	Loop:
+		for {
+			select {
+			case <-tick:
+				report(false)
+			case <-done:
+				break Loop
+			}
+		}
+		report(true)
+		if l != nil {
+			// Force a timestamp on the last rotated file and delete the resulting empty stats.json file.
+			l.Rotate()
+			os.Remove(filename)
+			l.Close()
+		}
+	}()
+	return reported
+}
+
+// printCaptureStats prints the capture statistics of each device, to the log while running and
+// to the summary at the end.
+func printCaptureStats(devices []CaptureStats, final bool) {
+	for _, d := range devices {
+		if final {
+			fmt.Printf("Captured %v packets on %s, with %v dropped by the kernel and %v by the interface.\n",
+				d.Received, d.Device, d.Dropped, d.IfDropped)
+		} else {
+			log.Printf("%s: received %v packets, dropped %v in the kernel and %v by the interface\n",
+				d.Device, d.Received, d.Dropped, d.IfDropped)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Testing
+
+// statsFile is an offline capture that reports capture statistics like a live device.
+type statsFile struct {
+	PacketSource
+	stats CaptureStats
+}
+
+func (s statsFile) captureStats() (CaptureStats, error) {
+	return s.stats, nil
+}
+
+func TestCaptureStats(t *testing.T) {
+	var sources []PacketSource
+	for i, name := range []string{"capture-a", "capture-b", "capture-b"} {
+		source, err := OpenOffline("testdata/rotated/" + name + ".pcap")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := uint64(i + 1)
+		sources = append(sources, statsFile{source, CaptureStats{Received: 100 * n, Dropped: 10 * n,
+			IfDropped: n}})
+	}
+	d := NewDevices([]string{"eth0", "eth1", "eth1"}, sources)
+	defer d.Close()
+
+	want := []CaptureStats{{"eth0", 100, 10, 1}, {"eth1", 500, 50, 5}}
+	got, err := d.CaptureStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	defer func(prefix string) { config.OutputPrefix = prefix }(config.OutputPrefix)
+	config.OutputPrefix = t.TempDir()
+	done := make(chan struct{})
+	close(done)
+	<-WriteCaptureStats(done, d)
+	files, _ := filepath.Glob(filepath.Join(config.OutputPrefix, "stats*.json"))
+	if len(files) != 1 {
+		t.Fatalf("got stats files %v, want one", files)
+	}
+	b, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record StatsRecord
+	if err := json.Unmarshal(b, &record); err != nil {
+		t.Fatal(err)
+	}
+	if !record.Final || !reflect.DeepEqual(record.Devices, want) {
+		t.Errorf("got record %+v, want the final stats %v", record, want)
+	}
+}
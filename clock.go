@@ -0,0 +1,87 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// packetClock is the capture time of the latest packet in Unix nanoseconds.  GeneratePackets sets
+// it and the output writers read it, so it is accessed atomically.
+var packetClock int64
+
+// setPacketClock advances the packet clock to a packet's capture time.  Out of order packets,
+// e.g. from another shard, don't turn it back.
+func setPacketClock(t time.Time) {
+	ns := t.UnixNano()
+	for {
+		clock := atomic.LoadInt64(&packetClock)
+		if ns <= clock || atomic.CompareAndSwapInt64(&packetClock, clock, ns) {
+			return
+		}
+	}
+}
+
+// outputClock returns the time that output files rotate by: the packet clock with
+// config.PacketClock, so that replayed captures rotate like they did live, and the wall clock
+// otherwise.
+func outputClock() time.Time {
+	if config.PacketClock {
+		return time.Unix(0, atomic.LoadInt64(&packetClock))
+	}
+	return time.Now()
+}
+
+// rotation tells a writer when its output file is due to rotate by the output clock.  An interval
+// of zero never rotates.
+type rotation struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// due returns true once per interval, starting one interval after it is first called.
+func (r *rotation) due() bool {
+	if r.interval <= 0 {
+		return false
+	}
+	now := outputClock()
+	if r.next.IsZero() {
+		r.next = now.Add(r.interval)
+		return false
+	}
+	if now.Before(r.next) {
+		return false
+	}
+	r.next = now.Add(r.interval)
+	return true
+}
+
+// pacer paces packets by their capture times at a multiple of their original speed, for
+// replaying offline captures as if they were live.
+type pacer struct {
+	speed float64
+	start time.Time // Wall time of the first packet
+	first time.Time // Capture time of the first packet
+}
+
+// wait sleeps until it is time for a packet to be processed.  It returns false if stop is
+// signaled first.
+func (p *pacer) wait(t time.Time, stop <-chan bool) bool {
+	if p.start.IsZero() {
+		p.start, p.first = time.Now(), t
+		return true
+	}
+	delay := time.Until(p.start.Add(time.Duration(float64(t.Sub(p.first)) / p.speed)))
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
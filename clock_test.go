@@ -0,0 +1,58 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Testing
+
+func TestRotationPacketClock(t *testing.T) {
+	config.PacketClock = true
+	defer func() { config.PacketClock = false }()
+	defer atomic.StoreInt64(&packetClock, 0)
+	atomic.StoreInt64(&packetClock, 0)
+
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := rotation{interval: 10 * time.Minute}
+	for _, test := range []struct {
+		minutes int
+		want    bool
+	}{
+		{0, false}, {5, false}, {10, true}, {12, false}, {20, true}, {15, false}, {45, true},
+	} {
+		setPacketClock(start.Add(time.Duration(test.minutes) * time.Minute))
+		if got := r.due(); got != test.want {
+			t.Errorf("at minute %d got %v, want %v", test.minutes, got, test.want)
+		}
+	}
+
+	never := rotation{}
+	setPacketClock(start.Add(time.Hour))
+	if never.due() || never.due() {
+		t.Error("rotation without an interval is due")
+	}
+}
+
+func TestPacer(t *testing.T) {
+	first := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	p := pacer{speed: 10}
+	begin := time.Now()
+	for _, offset := range []time.Duration{0, 100 * time.Millisecond, 500 * time.Millisecond} {
+		if !p.wait(first.Add(offset), nil) {
+			t.Fatal("wait was stopped")
+		}
+	}
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("500ms at 10x took %v, want about 50ms", elapsed)
+	}
+
+	stop := make(chan bool, 1)
+	stop <- true
+	if p.wait(first.Add(time.Hour), stop) {
+		t.Error("wait was not stopped")
+	}
+}
@@ -0,0 +1,101 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ICMP types paired with their counterparts for Community ID.  The counterpart stands in for the
+// destination port, so both directions of a request and reply get the same ID.
+var (
+	communityICMPv4 = map[uint8]uint8{
+		layers.ICMPv4TypeEchoRequest:         layers.ICMPv4TypeEchoReply,
+		layers.ICMPv4TypeEchoReply:           layers.ICMPv4TypeEchoRequest,
+		layers.ICMPv4TypeTimestampRequest:    layers.ICMPv4TypeTimestampReply,
+		layers.ICMPv4TypeTimestampReply:      layers.ICMPv4TypeTimestampRequest,
+		layers.ICMPv4TypeInfoRequest:         layers.ICMPv4TypeInfoReply,
+		layers.ICMPv4TypeInfoReply:           layers.ICMPv4TypeInfoRequest,
+		layers.ICMPv4TypeRouterSolicitation:  layers.ICMPv4TypeRouterAdvertisement,
+		layers.ICMPv4TypeRouterAdvertisement: layers.ICMPv4TypeRouterSolicitation,
+		layers.ICMPv4TypeAddressMaskRequest:  layers.ICMPv4TypeAddressMaskReply,
+		layers.ICMPv4TypeAddressMaskReply:    layers.ICMPv4TypeAddressMaskRequest,
+	}
+	communityICMPv6 = map[uint8]uint8{
+		layers.ICMPv6TypeEchoRequest:                         layers.ICMPv6TypeEchoReply,
+		layers.ICMPv6TypeEchoReply:                           layers.ICMPv6TypeEchoRequest,
+		layers.ICMPv6TypeRouterSolicitation:                  layers.ICMPv6TypeRouterAdvertisement,
+		layers.ICMPv6TypeRouterAdvertisement:                 layers.ICMPv6TypeRouterSolicitation,
+		layers.ICMPv6TypeNeighborSolicitation:                layers.ICMPv6TypeNeighborAdvertisement,
+		layers.ICMPv6TypeNeighborAdvertisement:               layers.ICMPv6TypeNeighborSolicitation,
+		layers.ICMPv6TypeMLDv1MulticastListenerQueryMessage:  layers.ICMPv6TypeMLDv1MulticastListenerReportMessage,
+		layers.ICMPv6TypeMLDv1MulticastListenerReportMessage: layers.ICMPv6TypeMLDv1MulticastListenerQueryMessage,
+		139: 140, // Node information query and response
+		140: 139,
+		144: 145, // Home agent address discovery request and reply
+		145: 144,
+	}
+)
+
+// CommunityID returns the Community ID v1 flow hash of the key with the given seed.  It is the
+// flow identifier shared with Zeek, Suricata, and other tools; see
+// https://github.com/corelight/community-id-spec.  Unlike Hash, it is stable across versions and
+// the same for both directions of a flow.  The VLAN and tunnel IDs are not part of the hash.
+func (ft FlowKey) CommunityID(seed uint16) string {
+	var (
+		sip          = net.ParseIP(ft.Sip.Address)
+		dip          = net.ParseIP(ft.Dip.Address)
+		sport, dport = ft.Sport, ft.Dport
+		oneWay       bool
+	)
+	if ft.Sip.Version == 4 {
+		sip, dip = sip.To4(), dip.To4()
+	}
+	if sip == nil || dip == nil {
+		return ""
+	}
+
+	switch ft.Proto {
+	case layers.IPProtocolICMPv4:
+		sport, dport, oneWay = communityICMPPorts(communityICMPv4, sport)
+	case layers.IPProtocolICMPv6:
+		sport, dport, oneWay = communityICMPPorts(communityICMPv6, sport)
+	}
+	// The lesser endpoint goes first, unless it's an ICMP message without a counterpart.
+	if !oneWay {
+		if c := bytes.Compare(sip, dip); c > 0 || (c == 0 && sport > dport) {
+			sip, dip = dip, sip
+			sport, dport = dport, sport
+		}
+	}
+
+	// seed, source address, destination address, protocol, padding, and ports for protocols
+	// that have them, all in network byte order
+	buf := make([]byte, 0, 2+2*net.IPv6len+2+4)
+	buf = append(buf, byte(seed>>8), byte(seed))
+	buf = append(buf, sip...)
+	buf = append(buf, dip...)
+	buf = append(buf, uint8(ft.Proto), 0)
+	switch ft.Proto {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolICMPv4,
+		layers.IPProtocolICMPv6, layers.IPProtocolSCTP:
+		buf = append(buf, byte(sport>>8), byte(sport), byte(dport>>8), byte(dport))
+	}
+	sum := sha1.Sum(buf)
+	return "1:" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// communityICMPPorts returns the port equivalents of an ICMP typecode for Community ID: the type
+// and its counterpart, or the type and code if it has none (a one-way message).
+func communityICMPPorts(counterparts map[uint8]uint8, typecode uint16) (uint16, uint16, bool) {
+	typ, code := uint8(typecode>>8), uint8(typecode)
+	if other, ok := counterparts[typ]; ok {
+		return uint16(typ), uint16(other), false
+	}
+	return uint16(typ), uint16(code), true
+}
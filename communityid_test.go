@@ -0,0 +1,51 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Testing
+
+func TestFlowKeyCommunityID(t *testing.T) {
+	v4 := func(a string) IPAddress { return IPAddress{Version: 4, Address: a} }
+	v6 := func(a string) IPAddress { return IPAddress{Version: 6, Address: a} }
+	echo := uint16(layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0))
+	echoReply := uint16(layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0))
+	neighborSol := uint16(layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0))
+	neighborAdv := uint16(layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0))
+
+	tests := []struct {
+		key  FlowKey
+		seed uint16
+		want string
+	}{
+		{FlowKey{Sip: v4("128.232.110.120"), Dip: v4("66.35.250.204"), Sport: 34855, Dport: 80,
+			Proto: layers.IPProtocolTCP}, 0, "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		{FlowKey{Sip: v4("66.35.250.204"), Dip: v4("128.232.110.120"), Sport: 80, Dport: 34855,
+			Proto: layers.IPProtocolTCP}, 0, "1:LQU9qZlK+B5F3KDmev6m5PMibrg="},
+		{FlowKey{Sip: v4("128.232.110.120"), Dip: v4("66.35.250.204"), Sport: 34855, Dport: 80,
+			Proto: layers.IPProtocolTCP, VlanID: 7}, 1, "1:3V71V58M3Ksw/yuFALMcW0LAHvc="},
+		{FlowKey{Sip: v4("192.168.0.89"), Dip: v4("192.168.0.1"), Sport: echo,
+			Proto: layers.IPProtocolICMPv4}, 0, "1:X0snYXpgwiv9TZtqg64sgzUn6Dk="},
+		{FlowKey{Sip: v4("192.168.0.1"), Dip: v4("192.168.0.89"), Sport: echoReply,
+			Proto: layers.IPProtocolICMPv4}, 0, "1:X0snYXpgwiv9TZtqg64sgzUn6Dk="},
+		{FlowKey{Sip: v6("fe80::200:86ff:fe05:80da"), Dip: v6("fe80::260:97ff:fe07:69ea"),
+			Sport: neighborSol, Proto: layers.IPProtocolICMPv6}, 0, "1:dGHyGvjMfljg6Bppwm3bg0LO8TY="},
+		{FlowKey{Sip: v6("fe80::260:97ff:fe07:69ea"), Dip: v6("fe80::200:86ff:fe05:80da"),
+			Sport: neighborAdv, Proto: layers.IPProtocolICMPv6}, 0, "1:dGHyGvjMfljg6Bppwm3bg0LO8TY="},
+		{FlowKey{Sip: v6("3ffe:507:0:1:200:86ff:fe05:80da"), Dip: v6("3ffe:507:0:1:260:97ff:fe07:69ea"),
+			Sport: 1022, Dport: 22, Proto: layers.IPProtocolTCP}, 0, "1:eOkdXgR8r0HD2Z2elZ+YOu9eyps="},
+		{FlowKey{Sip: v6("3ffe:507:0:1:200:86ff:fe05:80da"), Dip: v6("3ffe:507:0:1:260:97ff:fe07:69ea"),
+			Sport: 1022, Dport: 22, Proto: layers.IPProtocolUDP}, 0, "1:vRhNJocXG5ksY8TaRJLZDDjsyZo="},
+	}
+
+	for _, test := range tests {
+		if got := test.key.CommunityID(test.seed); got != test.want {
+			t.Errorf("%s (seed %d): got %s, want %s", test.key.String(), test.seed, got, test.want)
+		}
+	}
+}
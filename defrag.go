@@ -0,0 +1,279 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxFragmentRanges bounds the number of disjoint byte ranges a datagram may have while it is
+// reassembled.  Datagrams split into more pieces than this are discarded, since they are far more
+// likely an evasion attempt than real traffic.
+const maxFragmentRanges = 64
+
+// maxDatagramSize is the largest datagram payload we reassemble.
+const maxDatagramSize = 65535
+
+// ipv6Fragment decodes the IPv6 fragment extension header.  Unlike IPv6ExtensionSkipper, it stops
+// the parser at a fragment so that the datagram can be reassembled first.  An atomic fragment
+// (offset zero without more fragments) is decoded like any other extension header.
+type ipv6Fragment struct {
+	layers.BaseLayer
+	nextHeader layers.IPProtocol
+	offset     uint16 // Fragment offset in bytes
+	more       bool   // More fragments follow
+	id         uint32
+}
+
+// DecodeFromBytes decodes the fragment header at the start of data.
+func (f *ipv6Fragment) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return fmt.Errorf("Invalid ip6-fragment header. Length %d less than 8", len(data))
+	}
+	f.nextHeader = layers.IPProtocol(data[0])
+	f.offset = binary.BigEndian.Uint16(data[2:4]) &^ 0x7 // 13 bits of 8 byte units
+	f.more = data[3]&0x1 == 0x1
+	f.id = binary.BigEndian.Uint32(data[4:8])
+	f.BaseLayer = layers.BaseLayer{Contents: data[:8], Payload: data[8:]}
+	return nil
+}
+
+// CanDecode returns the IPv6 fragment layer type.
+func (f *ipv6Fragment) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeIPv6Fragment
+}
+
+// NextLayerType returns gopacket.LayerTypeFragment unless the fragment is atomic.
+func (f *ipv6Fragment) NextLayerType() gopacket.LayerType {
+	if f.offset != 0 || f.more {
+		return gopacket.LayerTypeFragment
+	}
+	return f.nextHeader.LayerType()
+}
+
+// fragmentKey identifies the fragments of one datagram.
+type fragmentKey struct {
+	src   [16]byte
+	dst   [16]byte
+	id    uint32
+	proto layers.IPProtocol
+}
+
+// Datagram is a packet reassembled from its fragments.
+type Datagram struct {
+	Payload      []byte            // The reassembled payload of the IP layer
+	Protocol     layers.IPProtocol // The protocol of the payload
+	NumFragments int               // The number of fragments, including duplicates and overlaps
+	Length       int               // The total captured length of the fragments
+	Overlaps     int               // The number of fragments that overlapped earlier ones
+	key          fragmentKey
+	firstSeen    time.Time
+	total        int      // Payload length once the last fragment is seen, otherwise -1
+	ranges       [][2]int // Sorted, disjoint [start, end) ranges received so far
+}
+
+// Defragmenter reassembles fragmented IPv4 and IPv6 packets.  It buffers at most maxBytes bytes of
+// incomplete datagrams, discarding the oldest when it needs room, and discards datagrams that are
+// still incomplete after timeout.  Overlapping fragments never overwrite bytes already received,
+// i.e. the first fragment wins.
+type Defragmenter struct {
+	datagrams      map[fragmentKey]*list.Element
+	order          *list.List // Incomplete datagrams in order of their first fragment
+	timeout        time.Duration
+	maxBytes       int
+	bytes          int
+	NumReassembled uint64 // Datagrams reassembled
+	NumDiscarded   uint64 // Incomplete datagrams discarded on timeout, for room, or as malformed
+	NumOverlaps    uint64 // Fragments that overlapped bytes already received
+}
+
+// NewDefragmenter returns a defragmenter with the given timeout and memory limit.
+func NewDefragmenter(timeout time.Duration, maxBytes int) *Defragmenter {
+	return &Defragmenter{datagrams: make(map[fragmentKey]*list.Element), order: list.New(),
+		timeout: timeout, maxBytes: maxBytes}
+}
+
+// AddIPv4 adds an IPv4 fragment captured at ts with the given captured length.  It returns the
+// datagram once all of its fragments have arrived, and nil otherwise.
+func (d *Defragmenter) AddIPv4(ip *layers.IPv4, ts time.Time, length int) *Datagram {
+	var key fragmentKey
+	copy(key.src[:], ip.SrcIP.To16())
+	copy(key.dst[:], ip.DstIP.To16())
+	key.id = uint32(ip.Id)
+	key.proto = ip.Protocol
+	return d.add(key, int(ip.FragOffset)*8, ip.Flags&layers.IPv4MoreFragments != 0, ip.Payload,
+		ts, length)
+}
+
+// AddIPv6 adds an IPv6 fragment captured at ts with the given captured length.  It returns the
+// datagram once all of its fragments have arrived, and nil otherwise.
+func (d *Defragmenter) AddIPv6(ip *layers.IPv6, frag *ipv6Fragment, ts time.Time,
+	length int) *Datagram {
+	var key fragmentKey
+	copy(key.src[:], ip.SrcIP.To16())
+	copy(key.dst[:], ip.DstIP.To16())
+	key.id = frag.id
+	key.proto = frag.nextHeader
+	return d.add(key, int(frag.offset), frag.more, frag.Payload, ts, length)
+}
+
+// add adds the fragment data at offset to its datagram.
+func (d *Defragmenter) add(key fragmentKey, offset int, more bool, data []byte, ts time.Time,
+	length int) *Datagram {
+	d.expire(ts)
+
+	var dg *Datagram
+	if e, ok := d.datagrams[key]; ok {
+		dg = e.Value.(*Datagram)
+	} else {
+		dg = &Datagram{Protocol: key.proto, key: key, firstSeen: ts, total: -1}
+		d.datagrams[key] = d.order.PushBack(dg)
+	}
+	dg.NumFragments++
+	dg.Length += length
+
+	end := offset + len(data)
+	switch {
+	case end > maxDatagramSize, !more && dg.total >= 0 && end != dg.total,
+		!more && end < dg.coverage(), dg.total >= 0 && end > dg.total:
+		// The fragment doesn't fit the datagram, so it can never be reassembled correctly.
+		d.remove(dg)
+		d.NumDiscarded++
+		return nil
+	}
+	if !more {
+		dg.total = end
+	}
+
+	// Make room for the new bytes.
+	if grow := end - len(dg.Payload); grow > 0 {
+		for d.bytes+grow > d.maxBytes && d.order.Front() != nil && d.order.Front().Value != dg {
+			d.remove(d.order.Front().Value.(*Datagram))
+			d.NumDiscarded++
+		}
+		if d.bytes+grow > d.maxBytes {
+			d.remove(dg)
+			d.NumDiscarded++
+			return nil
+		}
+		// The buffer is exactly as long as the payload so far, so that d.bytes is the memory we
+		// hold.
+		payload := make([]byte, end)
+		copy(payload, dg.Payload)
+		dg.Payload = payload
+		d.bytes += grow
+	}
+
+	// Copy the bytes we don't have yet; the first fragment to arrive wins.
+	if dg.fill(offset, data) {
+		dg.Overlaps++
+		d.NumOverlaps++
+	}
+	if len(dg.ranges) > maxFragmentRanges {
+		d.remove(dg)
+		d.NumDiscarded++
+		return nil
+	}
+	if dg.total >= 0 && len(dg.ranges) == 1 && dg.ranges[0] == [2]int{0, dg.total} {
+		d.remove(dg)
+		d.NumReassembled++
+		return dg
+	}
+	return nil
+}
+
+// expire discards datagrams that have been incomplete for longer than the timeout.
+func (d *Defragmenter) expire(now time.Time) {
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		dg := e.Value.(*Datagram)
+		if now.Sub(dg.firstSeen) <= d.timeout {
+			return
+		}
+		d.remove(dg)
+		d.NumDiscarded++
+	}
+}
+
+// Flush discards all incomplete datagrams.
+func (d *Defragmenter) Flush() {
+	for e := d.order.Front(); e != nil; e = d.order.Front() {
+		d.remove(e.Value.(*Datagram))
+		d.NumDiscarded++
+	}
+}
+
+// remove forgets a datagram.
+func (d *Defragmenter) remove(dg *Datagram) {
+	if e, ok := d.datagrams[dg.key]; ok {
+		d.order.Remove(e)
+		delete(d.datagrams, dg.key)
+		d.bytes -= len(dg.Payload)
+	}
+}
+
+// coverage returns the end of the highest byte range received.
+func (dg *Datagram) coverage() int {
+	if len(dg.ranges) == 0 {
+		return 0
+	}
+	return dg.ranges[len(dg.ranges)-1][1]
+}
+
+// fill copies the parts of data at offset that haven't been received yet into the payload and
+// merges its range into the ranges received.  It returns true if data overlapped bytes that were
+// already received.
+func (dg *Datagram) fill(offset int, data []byte) (overlap bool) {
+	start, end := offset, offset+len(data)
+	pos := start
+	for _, r := range dg.ranges {
+		if r[1] <= pos || r[0] >= end {
+			continue
+		}
+		if r[0] > pos {
+			copy(dg.Payload[pos:r[0]], data[pos-offset:r[0]-offset])
+		}
+		overlap = true
+		pos = r[1]
+		if pos >= end {
+			break
+		}
+	}
+	if pos < end {
+		copy(dg.Payload[pos:end], data[pos-offset:])
+	}
+
+	// Merge [start, end) into the sorted ranges.
+	merged := dg.ranges[:0:0]
+	placed := false
+	for _, r := range dg.ranges {
+		switch {
+		case r[1] < start:
+			merged = append(merged, r)
+		case r[0] > end:
+			if !placed {
+				merged = append(merged, [2]int{start, end})
+				placed = true
+			}
+			merged = append(merged, r)
+		default:
+			if r[0] < start {
+				start = r[0]
+			}
+			if r[1] > end {
+				end = r[1]
+			}
+		}
+	}
+	if !placed {
+		merged = append(merged, [2]int{start, end})
+	}
+	dg.ranges = merged
+	return overlap
+}
@@ -0,0 +1,117 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Testing
+
+func TestDefragmenter(t *testing.T) {
+	key := fragmentKey{id: 1, proto: 17}
+	start := time.Unix(1546300800, 0)
+	data := []byte("0123456789abcdefghijklmnopqrstuv")
+
+	tests := []struct {
+		name      string
+		fragments [][2]int // offset and end in data, the last without more fragments
+		want      []byte
+		overlaps  int
+	}{
+		{"in order", [][2]int{{0, 8}, {8, 16}, {16, 32}}, data, 0},
+		{"out of order", [][2]int{{16, 24}, {0, 8}, {8, 16}, {24, 32}}, data, 0},
+		{"duplicate", [][2]int{{0, 8}, {0, 8}, {8, 32}}, data, 1},
+		{"overlap", [][2]int{{0, 16}, {8, 24}, {24, 32}}, data, 1},
+		{"incomplete", [][2]int{{0, 8}, {16, 32}}, nil, 0},
+	}
+
+	for _, test := range tests {
+		d := NewDefragmenter(30*time.Second, 1024)
+		var dg *Datagram
+		for i, f := range test.fragments {
+			frag := data[f[0]:f[1]]
+			dg = d.add(key, f[0], i < len(test.fragments)-1, frag, start, 14+20+len(frag))
+		}
+		if test.want == nil {
+			if dg != nil || d.NumReassembled != 0 {
+				t.Errorf("%s: reassembled %q", test.name, dg.Payload)
+			}
+			continue
+		}
+		if dg == nil {
+			t.Errorf("%s: not reassembled", test.name)
+			continue
+		}
+		if !bytes.Equal(dg.Payload, test.want) || dg.Overlaps != test.overlaps ||
+			dg.NumFragments != len(test.fragments) {
+			t.Errorf("%s: got %q with %d fragments and %d overlaps, want %q with %d and %d",
+				test.name, dg.Payload, dg.NumFragments, dg.Overlaps, test.want,
+				len(test.fragments), test.overlaps)
+		}
+		if d.bytes != 0 || len(d.datagrams) != 0 {
+			t.Errorf("%s: %d bytes and %d datagrams left", test.name, d.bytes, len(d.datagrams))
+		}
+	}
+}
+
+func TestDefragmenterOverlapFirstWins(t *testing.T) {
+	d := NewDefragmenter(30*time.Second, 1024)
+	key := fragmentKey{id: 1, proto: 17}
+	now := time.Unix(1546300800, 0)
+	d.add(key, 0, true, []byte("AAAAAAAA"), now, 42)
+	d.add(key, 4, true, []byte("BBBBBBBB"), now, 42)
+	dg := d.add(key, 12, false, []byte("CCCC"), now, 38)
+	if dg == nil || string(dg.Payload) != "AAAAAAAABBBBCCCC" {
+		t.Errorf("got %v, want AAAAAAAABBBBCCCC", dg)
+	}
+	if d.NumOverlaps != 1 {
+		t.Errorf("got %d overlaps, want 1", d.NumOverlaps)
+	}
+}
+
+func TestDefragmenterLimits(t *testing.T) {
+	now := time.Unix(1546300800, 0)
+
+	// Datagrams that never complete time out.
+	d := NewDefragmenter(30*time.Second, 1024)
+	d.add(fragmentKey{id: 1}, 0, true, make([]byte, 8), now, 42)
+	d.add(fragmentKey{id: 2}, 0, true, make([]byte, 8), now.Add(31*time.Second), 42)
+	if d.NumDiscarded != 1 || len(d.datagrams) != 1 {
+		t.Errorf("timeout: got %d discarded and %d left, want 1 and 1", d.NumDiscarded,
+			len(d.datagrams))
+	}
+
+	// The oldest datagram makes room for new fragments when memory is full.
+	d = NewDefragmenter(30*time.Second, 24)
+	d.add(fragmentKey{id: 1}, 0, true, make([]byte, 16), now, 50)
+	d.add(fragmentKey{id: 2}, 0, true, make([]byte, 16), now, 50)
+	if _, ok := d.datagrams[fragmentKey{id: 1}]; ok || d.NumDiscarded != 1 || d.bytes != 16 {
+		t.Errorf("memory: got %d discarded and %d bytes, want the first datagram discarded",
+			d.NumDiscarded, d.bytes)
+	}
+
+	// Buffers count against the limit with their capacity, not just the bytes received.
+	d = NewDefragmenter(30*time.Second, 1<<20)
+	for i := 0; i < 4; i++ {
+		d.add(fragmentKey{id: 1}, 8*i, true, make([]byte, 8), now, 42)
+	}
+	if dg := d.datagrams[fragmentKey{id: 1}].Value.(*Datagram); cap(dg.Payload) != d.bytes {
+		t.Errorf("memory: got a %d byte buffer, but %d bytes counted", cap(dg.Payload), d.bytes)
+	}
+
+	// Fragments past the end of the datagram or too many holes are malformed.
+	d = NewDefragmenter(30*time.Second, 1<<20)
+	d.add(fragmentKey{id: 1}, 8, false, make([]byte, 8), now, 42)
+	d.add(fragmentKey{id: 1}, 16, true, make([]byte, 8), now, 42)
+	for i := 0; i <= maxFragmentRanges; i++ {
+		d.add(fragmentKey{id: 2}, 16*i, true, make([]byte, 8), now, 42)
+	}
+	d.Flush()
+	if d.NumDiscarded != 2 || d.NumReassembled != 0 || d.bytes != 0 {
+		t.Errorf("malformed: got %d discarded, %d reassembled, and %d bytes, want 2, 0, and 0",
+			d.NumDiscarded, d.NumReassembled, d.bytes)
+	}
+}
@@ -0,0 +1,307 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// mergeDelay is how long Devices holds on to a packet while a device that might have an earlier
+// one has nothing to read yet.  It is also how long a read waits for a packet before returning
+// errNoPacket.
+const mergeDelay = 100 * time.Millisecond
+
+// Devices is a PacketSource that captures from several live devices at once, e.g. the tap ports
+// of each direction of a link, and merges their packets by timestamp.  Each device has its own
+// reader goroutine and BPF filter.  Every device is interface 0 with its own name, so both
+// directions of a conversation make one flow while each flow records the device its first
+// packet was captured on.
+type Devices struct {
+	names     []string
+	sources   []PacketSource
+	linkTypes []layers.LinkType
+	packets   []chan devicePacket // From each reader; nil once a source is exhausted
+	heads     []*devicePacket     // The next packet of each device, if we have it
+	idle      []int32             // Whether the last read of each device timed out, set atomically
+	ready     chan struct{}       // Signaled when a reader sends a packet
+	buffers   sync.Pool           // Of *[]byte for copies of packets
+	last      *[]byte             // The copy returned by the last read, reused after the next
+	stop      chan struct{}
+	readers   sync.WaitGroup
+	started   bool
+	fanout    int        // AF_PACKET sockets per device, which follow each other in sources
+	shards    []*Devices // From Shards, which read the same sources
+}
+
+// devicePacket is a packet that a reader copied from its device into a buffer from the pool.
+type devicePacket struct {
+	data    *[]byte
+	ci      gopacket.CaptureInfo
+	arrived time.Time
+}
+
+// liveSource is a device that reports its capture statistics.
+type liveSource interface {
+	captureStats() (CaptureStats, error)
+}
+
+// pcapDevice is a live device captured with libpcap.
+type pcapDevice struct {
+	*pcap.Handle
+}
+
+// captureStats returns the packets received and dropped by libpcap's capture.
+func (p pcapDevice) captureStats() (CaptureStats, error) {
+	s, err := p.Stats()
+	if err != nil {
+		return CaptureStats{}, err
+	}
+	return CaptureStats{Received: uint64(s.PacketsReceived), Dropped: uint64(s.PacketsDropped),
+		IfDropped: uint64(s.PacketsIfDropped)}, nil
+}
+
+// OpenDevices opens live devices for capture, with libpcap or, with config.AFPacket, with one or
+// more AF_PACKET sockets per device.  Each socket is read like a device of its own, or by a
+// shard of its own with Shards.
+func OpenDevices(names []string) (*Devices, error) {
+	var sources []PacketSource
+	var sourceNames []string
+	for _, name := range names {
+		var handles []PacketSource
+		var err error
+		if config.AFPacket {
+			handles, err = openAFPacket(name)
+		} else {
+			var handle *pcap.Handle
+			handle, err = pcap.OpenLive(name, int32(config.SnapLen), true,
+				time.Duration(config.PcapTimeout))
+			handles = []PacketSource{pcapDevice{handle}}
+		}
+		if err != nil {
+			for _, source := range sources {
+				source.Close()
+			}
+			return nil, err
+		}
+		for _, handle := range handles {
+			sources = append(sources, handle)
+			sourceNames = append(sourceNames, name)
+		}
+	}
+	d := NewDevices(sourceNames, sources)
+	if config.AFPacket {
+		d.fanout = int(config.AFPacketFanout)
+	}
+	return d, nil
+}
+
+// NewDevices merges the packets of sources with the given names.  It takes ownership of the
+// sources, which are not read until the first packet is read from Devices.
+func NewDevices(names []string, sources []PacketSource) *Devices {
+	d := &Devices{names: names, sources: sources, heads: make([]*devicePacket, len(sources)),
+		ready: make(chan struct{}, 1), stop: make(chan struct{})}
+	for _, source := range sources {
+		d.linkTypes = append(d.linkTypes, source.LinkType())
+		d.packets = append(d.packets, make(chan devicePacket, 256))
+	}
+	d.idle = make([]int32, len(sources))
+	return d
+}
+
+// Shards splits the devices by AF_PACKET fanout socket.  The kernel hashes a flow to the same
+// socket index on every device, so each shard merges the sockets with one index and has every
+// packet of its flows.  Without fanout there is a single shard, and Shards returns nil.  The
+// shards read the sources of d, and closing d closes them.
+func (d *Devices) Shards() []PacketSource {
+	if d.fanout < 2 {
+		return nil
+	}
+	var shards []PacketSource
+	for i := 0; i < d.fanout; i++ {
+		var names []string
+		var sources []PacketSource
+		for j := i; j < len(d.sources); j += d.fanout {
+			names = append(names, d.names[j])
+			sources = append(sources, d.sources[j])
+		}
+		shard := NewDevices(names, sources)
+		d.shards = append(d.shards, shard)
+		shards = append(shards, shard)
+	}
+	return shards
+}
+
+// read copies packets from a device until it runs out or Devices is closed.  Read errors other
+// than the end of a file, e.g. timeouts, are skipped, and mark the device idle until its next
+// packet.
+func (d *Devices) read(i int) {
+	defer d.readers.Done()
+	defer close(d.packets[i])
+	for {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		data, ci, err := d.sources[i].ZeroCopyReadPacketData()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			atomic.StoreInt32(&d.idle[i], 1)
+			continue
+		}
+		atomic.StoreInt32(&d.idle[i], 0)
+		// The device reuses its buffer on the next read, so we copy the packet, but into a buffer
+		// that ZeroCopyReadPacketData gives back after its caller is done with it.
+		buf, _ := d.buffers.Get().(*[]byte)
+		if buf == nil {
+			buf = new([]byte)
+		}
+		*buf = append((*buf)[:0], data...)
+		p := devicePacket{data: buf, ci: ci, arrived: time.Now()}
+		select {
+		case d.packets[i] <- p:
+		case <-d.stop:
+			return
+		}
+		select {
+		case d.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ZeroCopyReadPacketData returns the earliest packet of all devices.  A packet is held for up to
+// mergeDelay while any device has nothing to compare it with yet, but not for idle devices, so
+// that a quiet device doesn't hold up a busy one.  Its InterfaceIndex is the index of its
+// device.  The data is only valid until the next call.
+func (d *Devices) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if d.last != nil {
+		d.buffers.Put(d.last)
+		d.last = nil
+	}
+	if !d.started {
+		d.started = true
+		d.readers.Add(len(d.sources))
+		for i := range d.sources {
+			go d.read(i)
+		}
+	}
+	timer := time.NewTimer(mergeDelay)
+	defer timer.Stop()
+	for {
+		earliest, waiting := -1, false
+		for i, packets := range d.packets {
+			if d.heads[i] == nil && packets != nil {
+				select {
+				case p, ok := <-packets:
+					if ok {
+						d.heads[i] = &p
+					} else {
+						d.packets[i] = nil
+					}
+				default:
+				}
+			}
+			if head := d.heads[i]; head == nil {
+				waiting = waiting || (d.packets[i] != nil && atomic.LoadInt32(&d.idle[i]) == 0)
+			} else if earliest < 0 || head.ci.Timestamp.Before(d.heads[earliest].ci.Timestamp) {
+				earliest = i
+			}
+		}
+		if earliest < 0 && !waiting {
+			return nil, gopacket.CaptureInfo{}, io.EOF
+		}
+		if earliest >= 0 && (!waiting || time.Since(d.heads[earliest].arrived) >= mergeDelay) {
+			p := d.heads[earliest]
+			d.heads[earliest] = nil
+			p.ci.InterfaceIndex = earliest
+			d.last = p.data
+			return *p.data, p.ci, nil
+		}
+		select {
+		case <-d.ready:
+		case <-timer.C:
+			if earliest < 0 {
+				return nil, gopacket.CaptureInfo{}, errNoPacket
+			}
+			timer.Reset(mergeDelay)
+		}
+	}
+}
+
+// LinkType returns the link type of the first device.
+func (d *Devices) LinkType() layers.LinkType {
+	return d.linkTypes[0]
+}
+
+// Interface returns the name and link type of a device.  Every device is interface 0 so that
+// they make the same flows.
+func (d *Devices) Interface(id int) (Interface, layers.LinkType) {
+	if id < 0 || id >= len(d.names) {
+		return Interface{}, d.linkTypes[0]
+	}
+	return Interface{Name: d.names[id]}, d.linkTypes[id]
+}
+
+// CaptureStats returns the capture statistics of each device, adding up those of the sockets of
+// a device with AF_PACKET fanout.  Sources that aren't live have none.
+func (d *Devices) CaptureStats() ([]CaptureStats, error) {
+	var devices []CaptureStats
+	index := make(map[string]int)
+	for i, source := range d.sources {
+		live, ok := source.(liveSource)
+		if !ok {
+			continue
+		}
+		s, err := live.captureStats()
+		if err != nil {
+			return nil, err
+		}
+		j, ok := index[d.names[i]]
+		if !ok {
+			j = len(devices)
+			index[d.names[i]] = j
+			devices = append(devices, CaptureStats{Device: d.names[i]})
+		}
+		devices[j].Received += s.Received
+		devices[j].Dropped += s.Dropped
+		devices[j].IfDropped += s.IfDropped
+	}
+	return devices, nil
+}
+
+// SetBPFFilter sets the same filter on every device, each compiling its own copy.
+func (d *Devices) SetBPFFilter(expr string) error {
+	for _, source := range d.sources {
+		if err := source.SetBPFFilter(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the readers, including those of its shards, and closes the devices once the
+// readers are done with them.
+func (d *Devices) Close() {
+	for _, shard := range d.shards {
+		shard.stopReaders()
+	}
+	d.stopReaders()
+	for _, source := range d.sources {
+		source.Close()
+	}
+}
+
+// stopReaders stops the readers and waits for them to be done with the devices.
+func (d *Devices) stopReaders() {
+	close(d.stop)
+	d.readers.Wait()
+}
@@ -0,0 +1,105 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Testing
+
+func TestDevices(t *testing.T) {
+	var sources []PacketSource
+	for _, name := range []string{"capture-a", "capture-b"} {
+		source, err := OpenOffline("testdata/rotated/" + name + ".pcap")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, source)
+	}
+	d := NewDevices([]string{"tap0", "tap1"}, sources)
+	defer d.Close()
+
+	type packet struct {
+		second int64
+		device string
+	}
+	var got []packet
+	for {
+		_, ci, err := d.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		iface, _ := d.Interface(ci.InterfaceIndex)
+		if iface.ID != 0 {
+			t.Errorf("%s has interface ID %d, want 0", iface.Name, iface.ID)
+		}
+		got = append(got, packet{ci.Timestamp.Unix() - 1546300800, iface.Name})
+	}
+	want := []packet{{0, "tap1"}, {10, "tap1"}, {20, "tap1"}, {60, "tap0"}, {70, "tap0"},
+		{80, "tap0"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// busyDevice is a live device that has n packets ready, one microsecond apart.
+type busyDevice struct {
+	n    int
+	next time.Time
+}
+
+func (b *busyDevice) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if b.n == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	b.n--
+	b.next = b.next.Add(time.Microsecond)
+	return make([]byte, 64), gopacket.CaptureInfo{Timestamp: b.next, CaptureLength: 64, Length: 64}, nil
+}
+func (b *busyDevice) LinkType() layers.LinkType      { return layers.LinkTypeEthernet }
+func (b *busyDevice) SetBPFFilter(expr string) error { return nil }
+func (b *busyDevice) Close()                         {}
+
+// idleDevice is a live device that never sees a packet, so its reads time out.
+type idleDevice struct {
+	busyDevice
+}
+
+func (i *idleDevice) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	time.Sleep(10 * time.Millisecond)
+	return nil, gopacket.CaptureInfo{}, errNoPacket
+}
+
+func TestDevicesIdle(t *testing.T) {
+	const n = 20000
+	d := NewDevices([]string{"eth0", "eth1"},
+		[]PacketSource{&busyDevice{n: n, next: time.Unix(1546300800, 0)}, &idleDevice{}})
+	defer d.Close()
+
+	begin := time.Now()
+	for read := 0; read < n; {
+		_, ci, err := d.ZeroCopyReadPacketData()
+		if err == errNoPacket {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if iface, _ := d.Interface(ci.InterfaceIndex); iface.Name != "eth0" {
+			t.Fatalf("got a packet from %s", iface.Name)
+		}
+		read++
+	}
+	// Holding packets back for the idle device would take about eight seconds.
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Errorf("reading %d packets beside an idle device took %v", n, elapsed)
+	}
+}
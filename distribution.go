@@ -0,0 +1,60 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// Upper bounds (exclusive) of the packet length histogram bins.  The last bin holds every packet
+// of at least 1518 bytes, i.e. jumbo frames and packets reassembled by offloading.
+var lengthBins = [...]uint16{64, 128, 256, 512, 1024, 1518}
+
+// LengthHistogram counts packets by length in the bins [0, 64), [64, 128), [128, 256),
+// [256, 512), [512, 1024), [1024, 1518), and [1518, ...).
+type LengthHistogram [len(lengthBins) + 1]uint64
+
+// add counts a packet of the given length.
+func (h *LengthHistogram) add(length uint16) {
+	for i, bound := range lengthBins {
+		if length < bound {
+			h[i]++
+			return
+		}
+	}
+	h[len(lengthBins)]++
+}
+
+// Distribution summarizes a series of values incrementally with Welford's algorithm.  StdDev is
+// the population standard deviation.
+type Distribution struct {
+	Min    float64
+	Max    float64
+	Mean   float64
+	StdDev float64
+	count  uint64
+	m2     float64 // Sum of squared differences from the mean
+}
+
+// add includes a value in the summary.
+func (d *Distribution) add(x float64) {
+	d.count++
+	if d.count == 1 || x < d.Min {
+		d.Min = x
+	}
+	if d.count == 1 || x > d.Max {
+		d.Max = x
+	}
+	delta := x - d.Mean
+	d.Mean += delta / float64(d.count)
+	d.m2 += delta * (x - d.Mean)
+	d.StdDev = math.Sqrt(d.m2 / float64(d.count))
+}
+
+// SPLTEntry is one packet of a flow's sequence of packet lengths and times (SPLT).
+type SPLTEntry struct {
+	Length        uint16        // Packet length
+	FromInitiator bool          // Was the packet sent by the initiator?
+	Offset        time.Duration // Time since the start of the flow
+}
@@ -0,0 +1,31 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Testing
+
+func TestDistribution(t *testing.T) {
+	var d Distribution
+	for _, x := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		d.add(x)
+	}
+	if d.Min != 2 || d.Max != 9 || d.Mean != 5 || math.Abs(d.StdDev-2) > 1e-9 {
+		t.Errorf("got %+v, want min 2, max 9, mean 5, and standard deviation 2", d)
+	}
+}
+
+func TestLengthHistogram(t *testing.T) {
+	var h LengthHistogram
+	for _, length := range []uint16{0, 54, 64, 127, 128, 300, 600, 1024, 1517, 1518, 9000} {
+		h.add(length)
+	}
+	want := LengthHistogram{2, 2, 1, 1, 1, 2, 2}
+	if h != want {
+		t.Errorf("got %v, want %v", h, want)
+	}
+}
@@ -5,6 +5,8 @@ package main
 import (
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket/layers"
@@ -15,32 +17,45 @@ const (
 	fnvPrime = 1099511628211
 )
 
-// fnvHash is based on the Fowler-Noll-Vo hash function (FNV-1a).
+// fnvAddString continues a hash h with the bytes of a string.  It is based on the
+// Fowler-Noll-Vo hash function (FNV-1a); start with h = fnvBasis for a new hash.
 // Source. https://en.wikipedia.org/wiki/Fowler–Noll–Vo_hash_function
-func fnvHashSlice(b []byte) (h uint64) {
-	h = fnvBasis
-	for i := 0; i < len(b); i++ {
-		h ^= uint64(b[i])
+func fnvAddString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
 		h *= fnvPrime
 	}
-	return
+	return h
 }
 
-// FlowKey is a standard 5-tuple plus a Vlan ID for 802.1q networks
+// FlowKey is a standard 5-tuple plus a Vlan ID for 802.1q networks, the outer Vlan ID for
+// 802.1ad (QinQ) networks, the type and virtual network ID of the tunnel that carried the flow, if
+// any, so that overlapping inner address spaces stay apart, and the ID of the capture interface,
+// so that flows seen on several interfaces of a pcapng file don't merge.
 type FlowKey struct {
-	Sip    IPAddress
-	Dip    IPAddress
-	Sport  uint16
-	Dport  uint16
-	Proto  layers.IPProtocol
-	VlanID uint16
+	Sip         IPAddress
+	Dip         IPAddress
+	Sport       uint16
+	Dport       uint16
+	Proto       layers.IPProtocol
+	VlanID      uint16
+	OuterVlanID uint16
+	TunnelType  string
+	TunnelID    uint32
+	InterfaceID uint32
 }
 
 // Hash provides a quick non-cryptographic hash value of a FlowKey.
 // Do not use for persistent key-value storage because it may change in future
-// versions.
+// versions.  The addresses are hashed in order, each followed by its IP version, so swapping the
+// source and destination changes the hash.  Equal hashes do not imply equal keys; see FlowCache.
 func (ft *FlowKey) Hash() (h uint64) {
-	h = fnvHashSlice([]byte(ft.Sip.Address)) + fnvHashSlice([]byte(ft.Dip.Address))
+	h = fnvAddString(fnvBasis, ft.Sip.Address)
+	h ^= uint64(ft.Sip.Version)
+	h *= fnvPrime
+	h = fnvAddString(h, ft.Dip.Address)
+	h ^= uint64(ft.Dip.Version)
+	h *= fnvPrime
 	h ^= uint64(ft.Sport)
 	h *= fnvPrime
 	h ^= uint64(ft.Dport)
@@ -49,9 +64,80 @@ func (ft *FlowKey) Hash() (h uint64) {
 	h *= fnvPrime
 	h ^= uint64(ft.VlanID)
 	h *= fnvPrime
+	h ^= uint64(ft.OuterVlanID)
+	h *= fnvPrime
+	h = fnvAddString(h, ft.TunnelType)
+	h ^= uint64(ft.TunnelID)
+	h *= fnvPrime
+	h ^= uint64(ft.InterfaceID)
+	h *= fnvPrime
 	return
 }
 
+// Canonical returns a direction-independent version of the key so that both directions of a
+// conversation map to the same bidirectional flow.  The lesser endpoint becomes the source.  ICMP
+// reply types are folded into their request types and ordering uses addresses only, since the
+// typecode in Sport is not a port.
+func (ft FlowKey) Canonical() FlowKey {
+	switch ft.Proto {
+	case layers.IPProtocolICMPv4:
+		ft.Sport = uint16(icmpv4Request(layers.ICMPv4TypeCode(ft.Sport)))
+		ft.Dport = 0
+		if ft.Dip.Address < ft.Sip.Address {
+			ft.Sip, ft.Dip = ft.Dip, ft.Sip
+		}
+		return ft
+	case layers.IPProtocolICMPv6:
+		ft.Sport = uint16(icmpv6Request(layers.ICMPv6TypeCode(ft.Sport)))
+		ft.Dport = 0
+		if ft.Dip.Address < ft.Sip.Address {
+			ft.Sip, ft.Dip = ft.Dip, ft.Sip
+		}
+		return ft
+	}
+	if ft.Dip.Address < ft.Sip.Address || (ft.Dip.Address == ft.Sip.Address && ft.Dport < ft.Sport) {
+		ft.Sip, ft.Dip = ft.Dip, ft.Sip
+		ft.Sport, ft.Dport = ft.Dport, ft.Sport
+	}
+	return ft
+}
+
+// Reverse returns the key for the opposite direction of the flow.
+func (ft FlowKey) Reverse() FlowKey {
+	ft.Sip, ft.Dip = ft.Dip, ft.Sip
+	ft.Sport, ft.Dport = ft.Dport, ft.Sport
+	return ft
+}
+
+// icmpv4Request maps ICMPv4 reply types to their request types and drops the code.  Other
+// types are returned unchanged.
+func icmpv4Request(tc layers.ICMPv4TypeCode) layers.ICMPv4TypeCode {
+	switch tc.Type() {
+	case layers.ICMPv4TypeEchoReply:
+		return layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)
+	case layers.ICMPv4TypeTimestampReply:
+		return layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimestampRequest, 0)
+	case layers.ICMPv4TypeInfoReply:
+		return layers.CreateICMPv4TypeCode(layers.ICMPv4TypeInfoRequest, 0)
+	case layers.ICMPv4TypeAddressMaskReply:
+		return layers.CreateICMPv4TypeCode(layers.ICMPv4TypeAddressMaskRequest, 0)
+	case layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeTimestampRequest,
+		layers.ICMPv4TypeInfoRequest, layers.ICMPv4TypeAddressMaskRequest:
+		return layers.CreateICMPv4TypeCode(tc.Type(), 0)
+	}
+	return tc
+}
+
+// icmpv6Request maps ICMPv6 echo replies to echo requests and drops the code.  Other types are
+// returned unchanged.
+func icmpv6Request(tc layers.ICMPv6TypeCode) layers.ICMPv6TypeCode {
+	switch tc.Type() {
+	case layers.ICMPv6TypeEchoReply, layers.ICMPv6TypeEchoRequest:
+		return layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)
+	}
+	return tc
+}
+
 func (ft FlowKey) String() string {
 	switch ft.Proto {
 	case layers.IPProtocolTCP:
@@ -71,15 +157,77 @@ func (ft FlowKey) String() string {
 		return fmt.Sprintf(" %s %d:%d %s -> %s", ft.Proto.String(),
 			layers.ICMPv6TypeCode(ft.Sport).Type(), layers.ICMPv6TypeCode(ft.Sport).Code(),
 			ft.Sip.Address, ft.Dip.Address)
+	case layers.IPProtocolGRE:
+		return fmt.Sprintf("%s %s -> %s", ft.Proto.String(), ft.Sip.Address, ft.Dip.Address)
 	default:
 		return fmt.Sprintf("* Unknown flow *")
 	}
 }
 
-// Flow is a complete description of a netflow session.
+// FlowEndpoint is one side of a flow and the traffic it sent.  For ICMP, Port holds the
+// typecode of the first packet the endpoint sent.  For TCP, Retransmissions counts segments that
+// resent bytes already seen, OutOfOrder counts segments that filled a sequence gap shortly after
+// it opened, and GapBytes is the sequence space the endpoint sent that never appeared in the
+// capture.  NumFragmented counts packets reassembled from the NumFragments IP fragments, of which
+// FragOverlaps overlapped earlier fragments.  PacketSizes (in bytes), InterArrivals (in
+// nanoseconds), and LengthHistogram describe the packets the endpoint sent.
+type FlowEndpoint struct {
+	IP              IPAddress
+	Port            uint16
+	NumPackets      uint64
+	NumBytes        uint64
+	NumPayloadBytes uint64
+	TCPFlags        uint8
+	Retransmissions uint64
+	OutOfOrder      uint64
+	GapBytes        uint64
+	NumFragmented   uint64
+	NumFragments    uint64
+	FragOverlaps    uint64
+	PacketSizes     Distribution
+	InterArrivals   Distribution
+	LengthHistogram LengthHistogram
+	sawFirstPayload bool
+	lastSeen        time.Time
+	seq             tcpSeqTracker
+}
+
+// update adds a packet sent by the endpoint to its counters and distributions.
+func (e *FlowEndpoint) update(mp *MetaPacket) {
+	e.NumPackets++
+	e.NumBytes += uint64(mp.packetLength)
+	e.NumPayloadBytes += uint64(mp.payloadLength)
+	e.TCPFlags |= mp.tcpFlags
+	if mp.fragments > 0 {
+		e.NumFragmented++
+		e.NumFragments += uint64(mp.fragments)
+		e.FragOverlaps += uint64(mp.overlaps)
+	}
+	e.PacketSizes.add(float64(mp.packetLength))
+	e.LengthHistogram.add(mp.packetLength)
+	if e.NumPackets > 1 {
+		// Out of order packets count as arriving at the same time as the previous one.
+		iat := mp.timestamp.Sub(e.lastSeen)
+		if iat < 0 {
+			iat = 0
+		}
+		e.InterArrivals.add(float64(iat))
+	}
+	if mp.timestamp.After(e.lastSeen) {
+		e.lastSeen = mp.timestamp
+	}
+}
+
+// Flow is a complete description of a netflow session.  The Initiator is the endpoint that sent
+// the first packet of the flow (or the SYN, if the first packet we saw was a SYN-ACK). In
+// bidirectional mode the Responder counts the traffic in the other direction; otherwise it only
+// names the destination.
 type Flow struct {
 	ID               uint64
 	Key              FlowKey
+	CommunityID      string
+	Tunnel           Tunnel
+	Interface        Interface
 	StartTime        time.Time
 	EndTime          time.Time
 	NumPackets       uint64
@@ -93,15 +241,31 @@ type Flow struct {
 	SawFINOnly       bool
 	ActiveTimeout    time.Time
 	SawFirstPayload  bool
+	Initiator        FlowEndpoint
+	Responder        FlowEndpoint
+	TCP              TCPConn
+	RTT              FlowRTT
+	SPLT             []SPLTEntry
+	Sequence         uint64
+	Delta            FlowDelta
+	exported         FlowDelta
+}
+
+// FlowDelta holds the traffic a flow has seen since its previous record.
+type FlowDelta struct {
+	NumPackets      uint64
+	NumBytes        uint64
+	NumPayloadBytes uint64
 }
 
-// Reasons for flow closure
+// Reasons for flow closure.  ClosureInterim marks an interim record of a flow that is still open.
 const (
 	ClosureNormal = iota
 	ClosureActiveTimeout
 	ClosureIdleTimeout
 	ClosureEOS
 	ClosureResourceExhaustion
+	ClosureInterim
 )
 
 // HasFINFlag ...
@@ -114,6 +278,27 @@ func (f *Flow) HasRSTFlag() bool {
 	return (f.FirstTCPFlags&RST == RST) || (f.RestTCPFlags&RST == RST)
 }
 
+// checkpoint sets Delta to the traffic seen since the previous record of the flow and marks the
+// current counters as exported.
+func (f *Flow) checkpoint() {
+	f.Delta.NumPackets = f.NumPackets - f.exported.NumPackets
+	f.Delta.NumBytes = f.NumBytes - f.exported.NumBytes
+	f.Delta.NumPayloadBytes = f.NumPayloadBytes - f.exported.NumPayloadBytes
+	f.exported = FlowDelta{f.NumPackets, f.NumBytes, f.NumPayloadBytes}
+}
+
+// fromInitiator returns true if the packet was sent by the flow's initiator.
+func (f *Flow) fromInitiator(mp *MetaPacket) bool {
+	if mp.sip != f.Initiator.IP {
+		return false
+	}
+	switch mp.protocol {
+	case layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		return true
+	}
+	return mp.sport == f.Initiator.Port
+}
+
 // Equal uses the Equaler interface because we only care that the flow keys are equal.
 // NOTE: Strictly, we may not need the Equaler interace if we commit to IPAddress without slices.
 func (f Flow) Equal(x Equaler) bool {
@@ -134,204 +319,346 @@ func (f Flow) String() string {
 // on specific termination conditions:
 // 1. A TCP session ends normally with FIN or a RST flag. We track if we see a FIN without an ACK
 //    since it may be considered anomalous.
-// 2. The map is full (terminate the oldest flows to free up resources).
-// 3. See a packet after ActiveTimeout seconds.
+// 2. The map is full (terminate the flows earliest to expire to free up resources).
+// 3. See a packet after ActiveTimeout seconds. With config.InterimRecords, we instead emit an
+//    interim record of the flow and keep it open.
 // 4. A flow doesn't see a packet after IdleTimeout seconds (PurgeIdleFlows() receiver method).
 //
-// TODO: Implement flow termination logic for reasons 2.
+// With config.FlowWorkers greater than one, AssignFlows shards packets across that many workers,
+// each with its own flow cache, and merges their flows and payloads onto the output channels.
 func AssignFlows(done <-chan struct{}, in <-chan MetaPacket) (<-chan Flow, <-chan FirstPayload) {
-	outFlow := make(chan Flow, 256)
-	outPayload := make(chan FirstPayload, 256)
+	workers := uint64(config.FlowWorkers)
+	if workers < 2 {
+		return assignWorkerFlows(done, []<-chan MetaPacket{in})
+	}
 
+	// Sharded mode: each worker has its own flow cache, and we spread packets across the workers
+	// with a direction-independent hash so that every packet of a flow (in either direction)
+	// lands on the same worker.
+	shards := make([]chan MetaPacket, workers)
+	ins := make([]<-chan MetaPacket, workers)
+	for i := range shards {
+		shards[i] = make(chan MetaPacket, 256)
+		ins[i] = shards[i]
+	}
 	go func() {
-		defer close(outFlow)
-		defer close(outPayload)
-
-		const (
-			capacity               = 10000000 // Ten million is pretty high
-			oooBound time.Duration = 5 * time.Microsecond
-		)
-		// These are cache variables that help us avoid allocating new variables and minimize GC
-		// activity in the goroutine.
-		var (
-			flowCache        = NewFlowCache(capacity)
-			currentTimestamp time.Time
-			mp               MetaPacket
-			fp               FirstPayload
-			numFlows         uint64
-			key              FlowKey
-			flow             Flow
-			hash             uint64
-			oooPacket        bool
-			ok               bool
-			deltaTimestamp   time.Duration
-			activeTimeout    = time.Duration(config.ActiveTimeout) * time.Second
-			idleTimeout      = time.Duration(config.IdleTimeout) * time.Second
-		)
-
+		var key FlowKey
 	Loop:
-		for mp = range in {
+		for mp := range in {
 			select {
 			case <-done:
 				break Loop
 			default:
-				// Update the current timestamp
-				deltaTimestamp = mp.timestamp.Sub(currentTimestamp)
-				oooPacket = false
-				if deltaTimestamp < -oooBound {
-					continue Loop // Drop packet because it's too old.
-				} else if (deltaTimestamp < 0) && (deltaTimestamp >= -oooBound) {
-					oooPacket = true // Out of order but keep it
-					log.Println("Out of order packet at ", mp.timestamp.String())
-				} else {
-					currentTimestamp = mp.timestamp
-				}
+				key = flowKeyOf(&mp).Canonical()
+				shards[key.Hash()%workers] <- mp
+			}
+		}
+		for i := range shards {
+			close(shards[i])
+		}
+	}()
+	return assignWorkerFlows(done, ins)
+}
 
-				// Purge inactive flows from the map and idle cache.  We make things easy and use a
-				// closure for the callback to IdleCache.Purge().
-				flowCache.Purge(currentTimestamp, func(flow Flow) {
-					if config.FilterSmallFlows && (flow.Key.Proto == layers.IPProtocolTCP) &&
-						(flow.NumPackets < 4) {
-						return
+// AssignShardFlows assigns the packets of several shards that already keep every packet of a
+// flow together, e.g. the shards of AF_PACKET fanout, to flows with a worker for each shard.  A
+// single shard is spread across config.FlowWorkers workers by AssignFlows instead.
+func AssignShardFlows(done <-chan struct{}, ins []<-chan MetaPacket) (<-chan Flow, <-chan FirstPayload) {
+	if len(ins) == 1 {
+		return AssignFlows(done, ins[0])
+	}
+	return assignWorkerFlows(done, ins)
+}
+
+// assignWorkerFlows runs a flow worker for each input, each with its own flow cache, and merges
+// their flows and payloads onto the output channels.
+func assignWorkerFlows(done <-chan struct{}, ins []<-chan MetaPacket) (<-chan Flow,
+	<-chan FirstPayload) {
+	outFlow := make(chan Flow, 256)
+	outPayload := make(chan FirstPayload, 256)
+
+	// The timeout policy table is shared (read-only) by all workers.  Without policies, it only
+	// holds the global timeouts, which is never an error.
+	policies := timeoutPolicies
+	if policies == nil {
+		policies, _ = NewTimeoutPolicies(nil, time.Duration(config.IdleTimeout)*time.Second,
+			time.Duration(config.ActiveTimeout)*time.Second)
+	}
+
+	var workerWG sync.WaitGroup
+	workers := uint64(len(ins))
+	for i, in := range ins {
+		workerWG.Add(1)
+		go func(worker uint64, in <-chan MetaPacket) {
+			assignFlows(done, in, outFlow, outPayload, policies, worker, workers)
+			workerWG.Done()
+		}(uint64(i), in)
+	}
+	go func() {
+		workerWG.Wait()
+		close(outFlow)
+		close(outPayload)
+		wg.Done()
+	}()
+	return outFlow, outPayload
+}
+
+// flowKeyOf returns the directional flow key of a packet.
+func flowKeyOf(mp *MetaPacket) FlowKey {
+	return FlowKey{Sip: mp.sip, Dip: mp.dip, Sport: mp.sport, Dport: mp.dport, Proto: mp.protocol,
+		VlanID: mp.vlanid, OuterVlanID: mp.outerVlanid, TunnelType: mp.tunnel.Type,
+		TunnelID: mp.tunnel.keyID(), InterfaceID: mp.iface.ID}
+}
+
+// assignFlows runs the flow assignment loop for one worker until the input channel closes.  The
+// worker numbers its flows worker+1, worker+1+workers, worker+1+2*workers, and so on, so flow
+// IDs are unique across all workers.  Each flow gets its idle and active timeouts from policies.
+// The workers share config.MaxFlows, so each holds at most its share of the flows.
+func assignFlows(done <-chan struct{}, in <-chan MetaPacket, outFlow chan<- Flow,
+	outPayload chan<- FirstPayload, policies *TimeoutPolicies, worker uint64, workers uint64) {
+
+	const oooBound time.Duration = 5 * time.Microsecond
+	// These are cache variables that help us avoid allocating new variables and minimize GC
+	// activity in the goroutine.
+	var (
+		flowCache        = NewFlowCache((config.MaxFlows + uint(workers) - 1) / uint(workers))
+		currentTimestamp time.Time
+		mp               MetaPacket
+		fp               FirstPayload
+		numFlows         uint64
+		numEvicted       uint64
+		key              FlowKey
+		ckey             FlowKey
+		flow             Flow
+		ep               *FlowEndpoint
+		hash             uint64
+		oooPacket        bool
+		ok               bool
+		deltaTimestamp   time.Duration
+		activeTimeout    time.Duration
+		idleTimeout      time.Duration
+	)
+
+	// emit sends a flow record on the output channel unless it is filtered out as a small flow,
+	// and returns true if it was sent.
+	emit := func(flow Flow, reason int) bool {
+		if config.FilterSmallFlows && (flow.Key.Proto == layers.IPProtocolTCP) &&
+			(flow.NumPackets < 4) {
+			return false
+		}
+		if config.Debug.PrintFlows {
+			fmt.Println(flow.String())
+		}
+		flow.checkpoint()
+		flow.ClosureReason = reason
+		outFlow <- flow
+		return true
+	}
+	// These are the callbacks to FlowCache.Purge() and FlowCache.Evict().
+	purgeIdle := func(flow Flow) { emit(flow, ClosureIdleTimeout) }
+	evictFull := func(flow Flow) { emit(flow, ClosureResourceExhaustion) }
+	evictEOS := func(flow Flow) { emit(flow, ClosureEOS) }
+
+Loop:
+	for mp = range in {
+		select {
+		case <-done:
+			break Loop
+		default:
+			// Update the current timestamp
+			deltaTimestamp = mp.timestamp.Sub(currentTimestamp)
+			oooPacket = false
+			if deltaTimestamp < -oooBound {
+				continue Loop // Drop packet because it's too old.
+			} else if (deltaTimestamp < 0) && (deltaTimestamp >= -oooBound) {
+				oooPacket = true // Out of order but keep it
+				log.Println("Out of order packet at ", mp.timestamp.String())
+			} else {
+				currentTimestamp = mp.timestamp
+			}
+
+			// Purge inactive flows from the map and idle cache.
+			flowCache.Purge(currentTimestamp, purgeIdle)
+
+			// Construct a flow key and its hash.
+			// REVIEW: This might be inefficient. Take a look at the sync/atomic Value type.
+			key = flowKeyOf(&mp)
+			ckey = key
+			if config.Biflow {
+				ckey = key.Canonical()
+			}
+			hash = ckey.Hash()
+
+			// Look up the key in the flow map.
+			// If it returns a hit, then we check if the packet triggers an active timeout
+			// termination. If so, we send the current flow with the key on the output channel
+			// and fall out of the branch to the code below, thus creating another flow with
+			// this key.  If the packet does not cause an active timeout, we may still terminate
+			// the flow if the packet is a TCP packet and has [FIN, ACK] or [RST] flags set.
+			// Otherwise, we update the flow and return.
+			// If there is no hit in the map table for this key, we create a new flow and add
+			// it to the table.
+			if flow, ok = flowCache.Fetch(ckey, hash); ok {
+				// Flow exists in the set. Update and terminate, if necessary.
+				// First, check for an active timeout for the flow.  In interim mode, we emit a
+				// checkpoint of the flow, re-arm its active timeout, and keep updating it.
+				if config.InterimRecords && mp.timestamp.After(flow.ActiveTimeout) {
+					if emit(flow, ClosureInterim) {
+						flow.checkpoint()
+						flow.Sequence++
 					}
-					if config.Debug.PrintFlows {
-						fmt.Println(flow.String())
+					_, activeTimeout = policies.Timeouts(&flow)
+					flow.ActiveTimeout = mp.timestamp.Add(activeTimeout)
+				}
+				if mp.timestamp.After(flow.ActiveTimeout) {
+					// Termination reason 3: Active timeout
+					flowCache.Remove(ckey, hash)
+					emit(flow, ClosureActiveTimeout)
+					// NOTE: Since this is a continuation of a flow, we create a new flow by
+					// dropping out of this branch. DO NOT RETURN.
+				} else {
+					// This branch updates an exising flow entry and, if applicable, terminates
+					// the flow if the packet is TCP and the terminal flags are set.
+					// NOTE. This branch *must* continue the loop.
+					if !oooPacket || (flow.EndTime.Before(mp.timestamp)) {
+						flow.EndTime = mp.timestamp
 					}
-					flow.ClosureReason = ClosureIdleTimeout
-					outFlow <- flow
-				})
-
-				// Construct a flow key and its hash.
-				// REVIEW: This might be inefficient. Take a look at the sync/atomic Value type.
-				key.Sip = mp.sip
-				key.Dip = mp.dip
-				key.Sport = mp.sport
-				key.Dport = mp.dport
-				key.Proto = mp.protocol
-				key.VlanID = mp.vlanid
-				hash = key.Hash()
-
-				// Look up the key in the flow map.
-				// If it returns a hit, then we check if the packet triggers an active timeout
-				// termination. If so, we send the current flow with the key on the output channel
-				// and fall out of the branch to the code below, thus creating another flow with
-				// this key.  If the packet does not cause an active timeout, we may still terminate
-				// the flow if the packet is a TCP packet and has [FIN, ACK] or [RST] flags set.
-				// Otherwise, we update the flow and return.
-				// If there is no hit in the map table for this key, we create a new flow and add
-				// it to the table.
-				if flow, ok = flowCache.Fetch(hash); ok {
-					// Flow exists in the set. Update and terminate, if necessary.
-					// First, check for an active timeout for the flow.
-					if mp.timestamp.After(flow.ActiveTimeout) {
-						// Termination reason 3: Active timeout
-						flowCache.Remove(hash)
-						if config.FilterSmallFlows && (flow.Key.Proto == layers.IPProtocolTCP) &&
-							(flow.NumPackets < 4) {
-							// This condition filters out small flows if the config is set.
-							continue Loop
-						}
-						if config.Debug.PrintFlows {
-							fmt.Println(flow.String())
-						}
-						flow.ClosureReason = ClosureActiveTimeout
-						outFlow <- flow
-						// NOTE: Since this is a continuation of a flow, we create a new flow by
-						// dropping out of this branch. DO NOT RETURN.
+					flow.NumPackets++
+					flow.NumBytes += uint64(mp.packetLength)
+					flow.NumPayloadBytes += uint64(mp.payloadLength)
+					if config.Biflow && !flow.fromInitiator(&mp) {
+						ep = &flow.Responder
 					} else {
-						// This branch updates an exising flow entry and, if applicable, terminates
-						// the flow if the packet is TCP and the terminal flags are set.
-						// NOTE. This branch *must* continue the loop.
-						if !oooPacket || (flow.EndTime.Before(mp.timestamp)) {
-							flow.EndTime = mp.timestamp
-						}
-						flow.NumPackets++
-						flow.NumBytes += uint64(mp.packetLength)
-						flow.NumPayloadBytes += uint64(mp.payloadLength)
-
-						if mp.protocol == layers.IPProtocolTCP {
-							flow.RestTCPFlags |= mp.tcpFlags
-							flow.LastTCPSequence = mp.tcpSeq
-							if !flow.SawFirstPayload && mp.payloadLength > 0 {
-								copy(fp.Payload[:], mp.payload[:])
-								fp.IP = mp.sip
-								fp.FlowID = flow.ID
-								fp.Seen = mp.timestamp
-								fp.Sport = mp.sport
-								fp.Dport = mp.dport
-								outPayload <- fp
-								flow.SawFirstPayload = true
+						ep = &flow.Initiator
+					}
+					ep.update(&mp)
+					if len(flow.SPLT) < cap(flow.SPLT) {
+						flow.SPLT = append(flow.SPLT, SPLTEntry{mp.packetLength,
+							ep == &flow.Initiator, mp.timestamp.Sub(flow.StartTime)})
+					}
+
+					if mp.protocol == layers.IPProtocolTCP {
+						flow.RestTCPFlags |= mp.tcpFlags
+						flow.LastTCPSequence = mp.tcpSeq
+						flow.TCP.update(mp.tcpFlags, mp.tcpSeq, ep == &flow.Initiator)
+						ep.updateSeq(&mp)
+						flow.RTT.handshake(&mp, ep == &flow.Initiator)
+						// An ACK from one side times the round trip from us to that side.
+						if ep == &flow.Initiator {
+							if rtt, ok := flow.Responder.updateAck(&mp); ok {
+								flow.RTT.Client.add(rtt)
 							}
+						} else if rtt, ok := flow.Initiator.updateAck(&mp); ok {
+							flow.RTT.Server.add(rtt)
+						}
+						// Each side of a biflow has its own first payload, so we keep both the
+						// client and server banners.
+						if !ep.sawFirstPayload && mp.payloadLength > 0 {
+							copy(fp.Payload[:], mp.payload[:])
+							fp.IP = mp.sip
+							fp.FlowID = flow.ID
+							fp.CommunityID = flow.CommunityID
+							fp.Seen = mp.timestamp
+							fp.Sport = mp.sport
+							fp.Dport = mp.dport
+							outPayload <- fp
+							ep.sawFirstPayload = true
+							flow.SawFirstPayload = true
+						}
 
-							// Termination reason 1: Normal TCP session ended with FIN or RST
-							if (mp.tcpFlags&FIN == FIN) || (mp.tcpFlags&RST == RST) {
-								if (mp.tcpFlags&FIN == FIN) && (mp.tcpFlags&ACK == 0x00) {
-									flow.SawFINOnly = true
-								}
-								if config.Debug.PrintFlows {
-									fmt.Println(flow.String())
-								}
-								flowCache.Remove(hash)
-								// This condition filters out small flows if the config is set.
-								if !(config.FilterSmallFlows && flow.NumPackets < 4) {
-									outFlow <- flow
-								}
+						// Termination reason 1: Normal TCP session ended with FIN or RST. A FIN
+						// only closes one direction of a biflow, so we wait for both of them.
+						if (mp.tcpFlags&FIN == FIN) || (mp.tcpFlags&RST == RST) {
+							if (mp.tcpFlags&FIN == FIN) && (mp.tcpFlags&ACK == 0x00) {
+								flow.SawFINOnly = true
+							}
+							if !config.Biflow || (mp.tcpFlags&RST == RST) ||
+								(flow.Initiator.TCPFlags&flow.Responder.TCPFlags&FIN == FIN) {
+								flowCache.Remove(ckey, hash)
+								emit(flow, ClosureNormal)
 								continue Loop
 							}
 						}
-						// We update a non-TCP flow or one that did not terminate normally, i.e.
-						// termination reason 1.
-						flowCache.Update(flow, hash, mp.timestamp.Add(idleTimeout))
-						continue Loop
 					}
+					// We update a non-TCP flow or one that did not terminate normally, i.e.
+					// termination reason 1.  The idle timeout may change with the TCP state.
+					idleTimeout, _ = policies.Timeouts(&flow)
+					flowCache.Update(flow, ckey, hash, mp.timestamp.Add(idleTimeout))
+					continue Loop
 				}
-				// Define a new flow.
-				numFlows++
-				flow.ID = numFlows
-				flow.Key = key
-				flow.StartTime = mp.timestamp
-				flow.EndTime = mp.timestamp
-				flow.ActiveTimeout = mp.timestamp.Add(activeTimeout)
-				flow.ClosureReason = ClosureNormal
-				flow.NumPackets = 1
-				flow.NumBytes = uint64(mp.packetLength)
-				flow.NumPayloadBytes = uint64(mp.payloadLength)
-				if mp.protocol == layers.IPProtocolTCP {
-					flow.FirstTCPFlags = mp.tcpFlags
-					flow.RestTCPFlags = 0
-					flow.FirstTCPSequence = mp.tcpSeq
-					flow.LastTCPSequence = mp.tcpSeq
-					flow.SawFINOnly = false
-					if !flow.SawFirstPayload && mp.payloadLength > 0 {
-						copy(fp.Payload[:], mp.payload[:])
-						fp.IP = mp.sip
-						fp.FlowID = flow.ID
-						fp.Seen = mp.timestamp
-						fp.Sport = mp.sport
-						fp.Dport = mp.dport
-						outPayload <- fp
-						flow.SawFirstPayload = true
-					}
-				}
-				flowCache.Insert(flow, hash, mp.timestamp.Add(idleTimeout))
 			}
-		}
+			// Termination reason 2: The flow cache is full, so we evict the flow earliest
+			// to expire to make room for the new one.
+			if flowCache.Full() {
+				numEvicted += uint64(flowCache.Evict(1, evictFull))
+			}
 
-		// Purge remaining flows from the flow cache.  We make things easy and use a
-		// closure for the callback to IdleCache.Purge().
-		flowCache.Purge(currentTimestamp.Add(activeTimeout), func(flow Flow) {
-			if config.FilterSmallFlows && (flow.Key.Proto == layers.IPProtocolTCP) &&
-				(flow.NumPackets < 4) {
-				return
+			// Define a new flow.
+			flow.ID = numFlows*workers + worker + 1
+			numFlows++
+			flow.Key = key
+			flow.CommunityID = key.CommunityID(uint16(config.CommunityIDSeed))
+			flow.Tunnel = mp.tunnel
+			flow.Interface = mp.iface
+			flow.StartTime = mp.timestamp
+			flow.EndTime = mp.timestamp
+			flow.ClosureReason = ClosureNormal
+			flow.NumPackets = 1
+			flow.NumBytes = uint64(mp.packetLength)
+			flow.NumPayloadBytes = uint64(mp.payloadLength)
+			flow.SawFirstPayload = false
+			flow.Sequence = 0
+			flow.exported = FlowDelta{}
+			flow.TCP = TCPConn{}
+			flow.RTT = FlowRTT{}
+			flow.Initiator = FlowEndpoint{IP: mp.sip, Port: mp.sport}
+			flow.Responder = FlowEndpoint{IP: mp.dip, Port: mp.dport}
+			flow.Initiator.update(&mp)
+			ep = &flow.Initiator
+			if config.Biflow && mp.protocol == layers.IPProtocolTCP && mp.tcpFlags&(SYN|ACK) == SYN|ACK {
+				// We missed the SYN, so the sender of this SYN-ACK is the responder.
+				flow.Key = key.Reverse()
+				flow.Initiator, flow.Responder = flow.Responder, flow.Initiator
+				ep = &flow.Responder
 			}
-			if config.Debug.PrintFlows {
-				fmt.Println(flow.String())
+			// Emitted flows may share the SPLT of the previous flow, so every flow gets its own.
+			flow.SPLT = nil
+			if config.SPLTLength > 0 {
+				flow.SPLT = make([]SPLTEntry, 1, config.SPLTLength)
+				flow.SPLT[0] = SPLTEntry{mp.packetLength, ep == &flow.Initiator, 0}
 			}
-			flow.ClosureReason = ClosureEOS
-			outFlow <- flow
-		})
-		stats.TotalFlows += numFlows
-		wg.Done()
-	}()
-	return outFlow, outPayload
+			if mp.protocol == layers.IPProtocolTCP {
+				flow.FirstTCPFlags = mp.tcpFlags
+				flow.RestTCPFlags = 0
+				flow.FirstTCPSequence = mp.tcpSeq
+				flow.LastTCPSequence = mp.tcpSeq
+				flow.SawFINOnly = false
+				flow.TCP.update(mp.tcpFlags, mp.tcpSeq, ep == &flow.Initiator)
+				ep.updateSeq(&mp)
+				flow.RTT.handshake(&mp, ep == &flow.Initiator)
+				if mp.payloadLength > 0 {
+					copy(fp.Payload[:], mp.payload[:])
+					fp.IP = mp.sip
+					fp.FlowID = flow.ID
+					fp.CommunityID = flow.CommunityID
+					fp.Seen = mp.timestamp
+					fp.Sport = mp.sport
+					fp.Dport = mp.dport
+					outPayload <- fp
+					ep.sawFirstPayload = true
+					flow.SawFirstPayload = true
+				}
+			}
+			idleTimeout, activeTimeout = policies.Timeouts(&flow)
+			flow.ActiveTimeout = mp.timestamp.Add(activeTimeout)
+			flowCache.Insert(flow, ckey, hash, mp.timestamp.Add(idleTimeout))
+		}
+	}
+
+	// Purge remaining flows from the flow cache.  Flows may have different timeouts, so we evict
+	// all of them rather than purging at a fixed time.
+	flowCache.Evict(int(flowCache.Len()), evictEOS)
+	atomic.AddUint64(&stats.TotalFlows, numFlows)
+	atomic.AddUint64(&stats.NumEvicted, numEvicted)
+	atomic.AddUint64(&stats.NumCollisions, flowCache.Collisions())
 }
@@ -7,11 +7,23 @@ import (
 	"os"
 	"testing"
 
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 )
 
 // Testing
 
+func TestFlowKeyHashSwappedAddresses(t *testing.T) {
+	a := FlowKey{Sip: IPAddress{4, "10.0.0.1"}, Dip: IPAddress{4, "10.0.0.2"}, Sport: 53, Dport: 53, Proto: layers.IPProtocolUDP}
+	b := a.Reverse()
+	if a.Hash() == b.Hash() {
+		t.Error("Swapping addresses with matching ports does not change the hash")
+	}
+	if a.Canonical() != b.Canonical() {
+		t.Error("Both directions of a flow have different canonical keys")
+	}
+}
+
 // Benchmarks
 
 func BenchmarkFlows(b *testing.B) {
@@ -186,30 +198,30 @@ func Example_flow_udpV4() {
 		stats.TotalPackets, stats.NumBytes, stats.TotalFlows, stats.NumDecoded, stats.NumTruncated)
 	os.RemoveAll(config.OutputPrefix)
 	// Output:
-	// 2009-04-07 14:57:26.36958 - 14:57:26.36958 (0s) UDP 192.168.0.6:1393 -> 199.45.32.43:53 (count: 1, bytes: 85, payload_bytes: 32)
-	// 2009-04-07 14:57:26.38144 - 14:57:26.38144 (0s) UDP 199.45.32.43:53 -> 192.168.0.6:1393 (count: 1, bytes: 121, payload_bytes: 32)
-	// 2009-04-07 14:57:26.38343 - 14:57:26.38343 (0s) UDP 192.168.0.6:1394 -> 199.45.32.43:53 (count: 1, bytes: 72, payload_bytes: 32)
-	// 2009-04-07 14:57:26.39546 - 14:57:26.39546 (0s) UDP 199.45.32.43:53 -> 192.168.0.6:1394 (count: 1, bytes: 88, payload_bytes: 32)
+	// 2009-04-07 14:57:26.36958 - 14:57:26.36958 (0s) UDP 192.168.0.6:1393 -> 199.45.32.43:53 (count: 1, bytes: 85, payload_bytes: 43)
+	// 2009-04-07 14:57:26.38144 - 14:57:26.38144 (0s) UDP 199.45.32.43:53 -> 192.168.0.6:1393 (count: 1, bytes: 121, payload_bytes: 79)
+	// 2009-04-07 14:57:26.38343 - 14:57:26.38343 (0s) UDP 192.168.0.6:1394 -> 199.45.32.43:53 (count: 1, bytes: 72, payload_bytes: 30)
+	// 2009-04-07 14:57:26.39546 - 14:57:26.39546 (0s) UDP 199.45.32.43:53 -> 192.168.0.6:1394 (count: 1, bytes: 88, payload_bytes: 46)
 	// 2009-04-27 21:29:55.99037 - 21:29:55.99037 (0s) UDP 192.168.0.5:1026 -> 83.170.6.76:3544 (count: 1, bytes: 119, payload_bytes: 77)
 	// 2009-04-27 21:29:56.10216 - 21:29:56.10216 (0s) UDP 83.170.6.76:3544 -> 192.168.0.5:1026 (count: 1, bytes: 159, payload_bytes: 117)
-	// 2009-04-27 21:33:37.88300 - 21:33:37.88300 (0s) UDP 192.168.0.5:1465 -> 199.45.32.43:53 (count: 1, bytes: 74, payload_bytes: 117)
-	// 2009-04-27 21:33:37.89556 - 21:33:37.89556 (0s) UDP 199.45.32.43:53 -> 192.168.0.5:1465 (count: 1, bytes: 142, payload_bytes: 117)
-	// 2009-04-27 21:37:26.03775 - 21:37:26.03775 (0s) UDP 192.168.0.7:35393 -> 199.45.32.43:53 (count: 1, bytes: 72, payload_bytes: 117)
-	// 2009-04-27 21:37:26.05036 - 21:37:26.05036 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:35393 (count: 1, bytes: 100, payload_bytes: 117)
-	// 2009-04-27 21:37:50.77412 - 21:37:50.77412 (0s) UDP 192.168.0.7:33912 -> 203.178.141.194:53 (count: 1, bytes: 72, payload_bytes: 117)
-	// 2009-04-27 21:37:50.97514 - 21:37:50.97514 (0s) UDP 203.178.141.194:53 -> 192.168.0.7:33912 (count: 1, bytes: 295, payload_bytes: 117)
-	// 2009-04-27 21:39:56.52384 - 21:39:56.52384 (0s) UDP 192.168.0.7:41008 -> 199.45.32.43:53 (count: 1, bytes: 132, payload_bytes: 117)
-	// 2009-04-27 21:39:56.92310 - 21:39:56.92310 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:41008 (count: 1, bytes: 161, payload_bytes: 117)
-	// 2009-04-27 21:40:53.51539 - 21:40:53.51539 (0s) UDP 192.168.0.7:37308 -> 199.45.32.43:53 (count: 1, bytes: 84, payload_bytes: 117)
-	// 2009-04-27 21:40:53.52835 - 21:40:53.52835 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:37308 (count: 1, bytes: 138, payload_bytes: 117)
-	// 2009-04-27 21:47:08.64744 - 21:47:08.64744 (0s) UDP 192.168.0.7:56309 -> 199.45.32.43:53 (count: 1, bytes: 70, payload_bytes: 117)
-	// 2009-04-27 21:47:08.65843 - 21:47:08.65843 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:56309 (count: 1, bytes: 206, payload_bytes: 117)
-	// 2009-04-27 21:47:17.52596 - 21:47:17.52596 (0s) UDP 192.168.0.7:45558 -> 199.45.32.43:53 (count: 1, bytes: 70, payload_bytes: 117)
-	// 2009-04-27 21:47:17.53708 - 21:47:17.53708 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:45558 (count: 1, bytes: 206, payload_bytes: 117)
-	// 2009-04-29 18:42:33.45696 - 18:42:33.45696 (0s) UDP 192.168.0.7:56305 -> 199.45.32.43:53 (count: 1, bytes: 75, payload_bytes: 117)
-	// 2009-04-29 18:42:33.47450 - 18:42:33.47450 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:56305 (count: 1, bytes: 112, payload_bytes: 117)
-	// 2009-04-29 18:44:36.04307 - 18:44:36.04307 (0s) UDP 192.168.0.7:53983 -> 199.45.32.43:53 (count: 1, bytes: 87, payload_bytes: 117)
-	// 2009-04-29 18:44:36.05559 - 18:44:36.05559 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:53983 (count: 1, bytes: 311, payload_bytes: 117)
+	// 2009-04-27 21:33:37.88300 - 21:33:37.88300 (0s) UDP 192.168.0.5:1465 -> 199.45.32.43:53 (count: 1, bytes: 74, payload_bytes: 32)
+	// 2009-04-27 21:33:37.89556 - 21:33:37.89556 (0s) UDP 199.45.32.43:53 -> 192.168.0.5:1465 (count: 1, bytes: 142, payload_bytes: 100)
+	// 2009-04-27 21:37:26.03775 - 21:37:26.03775 (0s) UDP 192.168.0.7:35393 -> 199.45.32.43:53 (count: 1, bytes: 72, payload_bytes: 30)
+	// 2009-04-27 21:37:26.05036 - 21:37:26.05036 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:35393 (count: 1, bytes: 100, payload_bytes: 58)
+	// 2009-04-27 21:37:50.77412 - 21:37:50.77412 (0s) UDP 192.168.0.7:33912 -> 203.178.141.194:53 (count: 1, bytes: 72, payload_bytes: 30)
+	// 2009-04-27 21:37:50.97514 - 21:37:50.97514 (0s) UDP 203.178.141.194:53 -> 192.168.0.7:33912 (count: 1, bytes: 295, payload_bytes: 253)
+	// 2009-04-27 21:39:56.52384 - 21:39:56.52384 (0s) UDP 192.168.0.7:41008 -> 199.45.32.43:53 (count: 1, bytes: 132, payload_bytes: 90)
+	// 2009-04-27 21:39:56.92310 - 21:39:56.92310 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:41008 (count: 1, bytes: 161, payload_bytes: 119)
+	// 2009-04-27 21:40:53.51539 - 21:40:53.51539 (0s) UDP 192.168.0.7:37308 -> 199.45.32.43:53 (count: 1, bytes: 84, payload_bytes: 42)
+	// 2009-04-27 21:40:53.52835 - 21:40:53.52835 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:37308 (count: 1, bytes: 138, payload_bytes: 96)
+	// 2009-04-27 21:47:08.64744 - 21:47:08.64744 (0s) UDP 192.168.0.7:56309 -> 199.45.32.43:53 (count: 1, bytes: 70, payload_bytes: 28)
+	// 2009-04-27 21:47:08.65843 - 21:47:08.65843 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:56309 (count: 1, bytes: 206, payload_bytes: 164)
+	// 2009-04-27 21:47:17.52596 - 21:47:17.52596 (0s) UDP 192.168.0.7:45558 -> 199.45.32.43:53 (count: 1, bytes: 70, payload_bytes: 28)
+	// 2009-04-27 21:47:17.53708 - 21:47:17.53708 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:45558 (count: 1, bytes: 206, payload_bytes: 164)
+	// 2009-04-29 18:42:33.45696 - 18:42:33.45696 (0s) UDP 192.168.0.7:56305 -> 199.45.32.43:53 (count: 1, bytes: 75, payload_bytes: 33)
+	// 2009-04-29 18:42:33.47450 - 18:42:33.47450 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:56305 (count: 1, bytes: 112, payload_bytes: 70)
+	// 2009-04-29 18:44:36.04307 - 18:44:36.04307 (0s) UDP 192.168.0.7:53983 -> 199.45.32.43:53 (count: 1, bytes: 87, payload_bytes: 45)
+	// 2009-04-29 18:44:36.05559 - 18:44:36.05559 (0s) UDP 199.45.32.43:53 -> 192.168.0.7:53983 (count: 1, bytes: 311, payload_bytes: 269)
 	// Processed 24 packets (3051 bytes) in 24 flows with 24 decoded, and 0 truncated.
 }
 
@@ -247,22 +259,22 @@ func Example_flow_udpV6() {
 	// Output:
 	// 2009-04-28 02:57:03.47668 - 02:57:03.47668 (0s) UDP fe80::5.1026 -> fe80::76.3544 (count: 1, bytes: 139, payload_bytes: 77)
 	// 2009-04-28 02:57:03.48219 - 02:57:03.48219 (0s) UDP fe80::76.3544 -> fe80::5.1026 (count: 1, bytes: 179, payload_bytes: 117)
-	// 2009-04-28 02:57:03.64097 - 02:57:03.64097 (0s) UDP fe80::7.35393 -> fe80::43.53 (count: 1, bytes: 92, payload_bytes: 117)
-	// 2009-04-28 02:57:03.64317 - 02:57:03.64317 (0s) UDP fe80::43.53 -> fe80::7.35393 (count: 1, bytes: 132, payload_bytes: 117)
-	// 2009-04-28 02:57:03.65489 - 02:57:03.65489 (0s) UDP fe80::7.41008 -> fe80::43.53 (count: 1, bytes: 152, payload_bytes: 117)
-	// 2009-04-28 02:57:03.67070 - 02:57:03.67070 (0s) UDP fe80::7.56309 -> fe80::43.53 (count: 1, bytes: 90, payload_bytes: 117)
-	// 2009-04-28 02:57:03.67286 - 02:57:03.67286 (0s) UDP fe80::43.53 -> fe80::7.56309 (count: 1, bytes: 362, payload_bytes: 117)
-	// 2009-04-28 02:57:04.15066 - 02:57:04.15066 (0s) UDP fe80::7.45558 -> fe80::43.53 (count: 1, bytes: 90, payload_bytes: 117)
-	// 2009-04-28 02:57:04.15282 - 02:57:04.15282 (0s) UDP fe80::43.53 -> fe80::7.45558 (count: 1, bytes: 314, payload_bytes: 117)
-	// 2009-04-28 02:57:04.22950 - 02:57:04.22950 (0s) UDP fe80::7.33912 -> fe80::194.53 (count: 1, bytes: 92, payload_bytes: 117)
-	// 2009-04-28 02:57:04.23171 - 02:57:04.23171 (0s) UDP fe80::194.53 -> fe80::7.33912 (count: 1, bytes: 444, payload_bytes: 117)
-	// 2009-04-28 02:57:04.37197 - 02:57:04.37197 (0s) UDP fe80::5.1465 -> fe80::43.53 (count: 1, bytes: 94, payload_bytes: 117)
-	// 2009-04-28 02:57:04.37414 - 02:57:04.37414 (0s) UDP fe80::43.53 -> fe80::5.1465 (count: 1, bytes: 234, payload_bytes: 117)
-	// 2009-04-28 02:57:04.38861 - 02:57:04.38861 (0s) UDP fe80::7.37308 -> fe80::43.53 (count: 1, bytes: 104, payload_bytes: 117)
-	// 2009-04-29 18:46:45.56711 - 18:46:45.56711 (0s) UDP fe80::7.53983 -> fe80::43.53 (count: 1, bytes: 107, payload_bytes: 117)
-	// 2009-04-29 18:46:45.56939 - 18:46:45.56939 (0s) UDP fe80::43.53 -> fe80::7.53983 (count: 1, bytes: 466, payload_bytes: 117)
-	// 2009-04-29 18:46:45.59107 - 18:46:45.59107 (0s) UDP fe80::7.56305 -> fe80::43.53 (count: 1, bytes: 95, payload_bytes: 117)
-	// 2009-04-29 18:46:45.59340 - 18:46:45.59340 (0s) UDP fe80::43.53 -> fe80::7.56305 (count: 1, bytes: 174, payload_bytes: 117)
+	// 2009-04-28 02:57:03.64097 - 02:57:03.64097 (0s) UDP fe80::7.35393 -> fe80::43.53 (count: 1, bytes: 92, payload_bytes: 30)
+	// 2009-04-28 02:57:03.64317 - 02:57:03.64317 (0s) UDP fe80::43.53 -> fe80::7.35393 (count: 1, bytes: 132, payload_bytes: 70)
+	// 2009-04-28 02:57:03.65489 - 02:57:03.65489 (0s) UDP fe80::7.41008 -> fe80::43.53 (count: 1, bytes: 152, payload_bytes: 90)
+	// 2009-04-28 02:57:03.67070 - 02:57:03.67070 (0s) UDP fe80::7.56309 -> fe80::43.53 (count: 1, bytes: 90, payload_bytes: 28)
+	// 2009-04-28 02:57:03.67286 - 02:57:03.67286 (0s) UDP fe80::43.53 -> fe80::7.56309 (count: 1, bytes: 362, payload_bytes: 300)
+	// 2009-04-28 02:57:04.15066 - 02:57:04.15066 (0s) UDP fe80::7.45558 -> fe80::43.53 (count: 1, bytes: 90, payload_bytes: 28)
+	// 2009-04-28 02:57:04.15282 - 02:57:04.15282 (0s) UDP fe80::43.53 -> fe80::7.45558 (count: 1, bytes: 314, payload_bytes: 252)
+	// 2009-04-28 02:57:04.22950 - 02:57:04.22950 (0s) UDP fe80::7.33912 -> fe80::194.53 (count: 1, bytes: 92, payload_bytes: 30)
+	// 2009-04-28 02:57:04.23171 - 02:57:04.23171 (0s) UDP fe80::194.53 -> fe80::7.33912 (count: 1, bytes: 444, payload_bytes: 382)
+	// 2009-04-28 02:57:04.37197 - 02:57:04.37197 (0s) UDP fe80::5.1465 -> fe80::43.53 (count: 1, bytes: 94, payload_bytes: 32)
+	// 2009-04-28 02:57:04.37414 - 02:57:04.37414 (0s) UDP fe80::43.53 -> fe80::5.1465 (count: 1, bytes: 234, payload_bytes: 172)
+	// 2009-04-28 02:57:04.38861 - 02:57:04.38861 (0s) UDP fe80::7.37308 -> fe80::43.53 (count: 1, bytes: 104, payload_bytes: 42)
+	// 2009-04-29 18:46:45.56711 - 18:46:45.56711 (0s) UDP fe80::7.53983 -> fe80::43.53 (count: 1, bytes: 107, payload_bytes: 45)
+	// 2009-04-29 18:46:45.56939 - 18:46:45.56939 (0s) UDP fe80::43.53 -> fe80::7.53983 (count: 1, bytes: 466, payload_bytes: 404)
+	// 2009-04-29 18:46:45.59107 - 18:46:45.59107 (0s) UDP fe80::7.56305 -> fe80::43.53 (count: 1, bytes: 95, payload_bytes: 33)
+	// 2009-04-29 18:46:45.59340 - 18:46:45.59340 (0s) UDP fe80::43.53 -> fe80::7.56305 (count: 1, bytes: 174, payload_bytes: 112)
 	// Processed 20 packets (3360 bytes) in 18 flows with 18 decoded, and 0 truncated.
 }
 
@@ -322,3 +334,370 @@ func Example_flow_vlan() {
 	// 2012-07-18 20:09:51.25377 - 20:09:51.25377 (0s) TCP 10.0.0.6:8080 -> 10.0.0.9:60285 (count: 1, bytes: 60, payload_bytes: 0)
 	// Processed 239 packets (144569 bytes) in 22 flows with 239 decoded, and 0 truncated.
 }
+
+func Example_flow_biflowIcmp() {
+	var handle *pcap.Handle
+	handle, _ = pcap.OpenOffline("testdata/icmp.pcap")
+	defer handle.Close()
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+	config.Biflow = true
+	defer func() { config.Biflow = false }()
+
+	// State
+	stats.NumBytes = 0
+	stats.NumDecoded = 0
+	stats.NumTruncated = 0
+	stats.TotalPackets = 0
+	stats.TotalFlows = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for f := range inFlows {
+		fmt.Println(f.String())
+		fmt.Printf("initiator: %s (count: %v, bytes: %v), responder: %s (count: %v, bytes: %v)\n",
+			f.Initiator.IP.Address, f.Initiator.NumPackets, f.Initiator.NumBytes,
+			f.Responder.IP.Address, f.Responder.NumPackets, f.Responder.NumBytes)
+	}
+	wg.Wait()
+	fmt.Printf("Processed %v packets (%v bytes) in %v flows with %v decoded, and %v truncated.\n",
+		stats.TotalPackets, stats.NumBytes, stats.TotalFlows, stats.NumDecoded, stats.NumTruncated)
+	// Output:
+	// 2011-06-27 03:21:27.02426 - 03:21:30.03047 (3.00621s)  ICMPv4 8:0 192.168.0.89 -> 192.168.0.1 (count: 12, bytes: 888, payload_bytes: 384)
+	// initiator: 192.168.0.89 (count: 8, bytes: 592), responder: 192.168.0.1 (count: 4, bytes: 296)
+	// Processed 12 packets (888 bytes) in 1 flows with 12 decoded, and 0 truncated.
+}
+
+func Example_flow_biflowTCPCompleteV4() {
+	var handle *pcap.Handle
+	handle, _ = pcap.OpenOffline("testdata/tcp-complete-v4.pcap")
+	defer handle.Close()
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+	config.Biflow = true
+	defer func() { config.Biflow = false }()
+
+	// State
+	stats.NumBytes = 0
+	stats.NumDecoded = 0
+	stats.NumTruncated = 0
+	stats.TotalPackets = 0
+	stats.TotalFlows = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for f := range inFlows {
+		fmt.Println(f.String())
+		fmt.Printf("initiator: %s:%d (count: %v, flags: %#x), responder: %s:%d (count: %v, flags: %#x)\n",
+			f.Initiator.IP.Address, f.Initiator.Port, f.Initiator.NumPackets, f.Initiator.TCPFlags,
+			f.Responder.IP.Address, f.Responder.Port, f.Responder.NumPackets, f.Responder.TCPFlags)
+		fmt.Printf("state: %s, handshake: %v, closed by: %s\n", f.TCP.State, f.TCP.HandshakeComplete,
+			f.TCP.ClosedBy)
+	}
+	wg.Wait()
+	fmt.Printf("Processed %v packets (%v bytes) in %v flows with %v decoded, and %v truncated.\n",
+		stats.TotalPackets, stats.NumBytes, stats.TotalFlows, stats.NumDecoded, stats.NumTruncated)
+	// Output:
+	// 2009-04-27 21:00:04.06610 - 21:00:07.17391 (3.107803s) TCP 192.168.0.5:1449 -> 192.168.0.7:2111 (count: 4, bytes: 232, payload_bytes: 0)
+	// initiator: 192.168.0.5:1449 (count: 3, flags: 0x16), responder: 192.168.0.7:2111 (count: 1, flags: 0x12)
+	// state: RSTO, handshake: true, closed by: initiator
+	// 2009-04-27 21:00:07.17394 - 21:00:07.17394 (0s) TCP 192.168.0.7:2111 -> 192.168.0.5:1449 (count: 1, bytes: 60, payload_bytes: 0)
+	// initiator: 192.168.0.7:2111 (count: 1, flags: 0x11), responder: 192.168.0.5:1449 (count: 0, flags: 0x0)
+	// state: OTH, handshake: false, closed by: initiator
+	// Processed 5 packets (292 bytes) in 2 flows with 5 decoded, and 0 truncated.
+}
+
+func Example_flow_biflowTCPDNS() {
+	var handle *pcap.Handle
+	handle, _ = pcap.OpenOffline("testdata/tcp-dns.pcap")
+	defer handle.Close()
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+	config.Biflow = true
+	defer func() { config.Biflow = false }()
+
+	// State
+	stats.NumBytes = 0
+	stats.NumDecoded = 0
+	stats.NumTruncated = 0
+	stats.TotalPackets = 0
+	stats.TotalFlows = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for f := range inFlows {
+		fmt.Println(f.String())
+		for _, e := range []FlowEndpoint{f.Initiator, f.Responder} {
+			fmt.Printf("%s:%d (payload_bytes: %v, retransmissions: %v, out of order: %v, gap bytes: %v)\n",
+				e.IP.Address, e.Port, e.NumPayloadBytes, e.Retransmissions, e.OutOfOrder, e.GapBytes)
+		}
+	}
+	wg.Wait()
+	fmt.Printf("Processed %v packets (%v bytes) in %v flows with %v decoded, and %v truncated.\n",
+		stats.TotalPackets, stats.NumBytes, stats.TotalFlows, stats.NumDecoded, stats.NumTruncated)
+	// Output:
+	// 2019-01-01 00:00:00.00100 - 00:00:00.00700 (6ms) TCP 10.0.0.1:40000 -> 10.0.0.53:53 (count: 7, bytes: 456, payload_bytes: 78)
+	// 10.0.0.1:40000 (payload_bytes: 31, retransmissions: 0, out of order: 0, gap bytes: 0)
+	// 10.0.0.53:53 (payload_bytes: 47, retransmissions: 0, out of order: 0, gap bytes: 0)
+	// 2019-01-01 00:00:00.00000 - 00:00:00.00000 (0s) TCP 10.0.0.1:41000 -> 10.0.0.80:80 (count: 1, bytes: 474, payload_bytes: 420)
+	// 10.0.0.1:41000 (payload_bytes: 420, retransmissions: 0, out of order: 0, gap bytes: 0)
+	// 10.0.0.80:80 (payload_bytes: 0, retransmissions: 0, out of order: 0, gap bytes: 0)
+	// Processed 8 packets (930 bytes) in 2 flows with 8 decoded, and 0 truncated.
+}
+
+func TestAssignFlowsSharded(t *testing.T) {
+	var handle *pcap.Handle
+	handle, _ = pcap.OpenOffline("testdata/vlan.pcap")
+	defer handle.Close()
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+	config.FlowWorkers = 4
+	defer func() { config.FlowWorkers = 1 }()
+
+	// State
+	stats.TotalFlows = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	ids := make(map[uint64]bool)
+	var packets uint64
+	for f := range inFlows {
+		if ids[f.ID] {
+			t.Errorf("Flow ID %v is not unique", f.ID)
+		}
+		ids[f.ID] = true
+		packets += f.NumPackets
+	}
+	wg.Wait()
+	if len(ids) != 22 || stats.TotalFlows != 22 {
+		t.Errorf("Got %v flows (%v in stats), want 22", len(ids), stats.TotalFlows)
+	}
+	if packets != 239 {
+		t.Errorf("Got %v packets in flows, want 239", packets)
+	}
+}
+
+func TestAssignShardFlows(t *testing.T) {
+	// Two shards of the same capture, which share the statistics and flow IDs.
+	var shards []PacketSource
+	for i := 0; i < 2; i++ {
+		handle, _ := pcap.OpenOffline("testdata/vlan.pcap")
+		defer handle.Close()
+		shards = append(shards, handle)
+	}
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+
+	// State
+	stats.TotalPackets = 0
+	stats.TotalFlows = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GenerateShardPackets(done, shards)
+	inFlows, _ := AssignShardFlows(done, inPackets)
+	ids := make(map[uint64]bool)
+	var packets uint64
+	for f := range inFlows {
+		if ids[f.ID] {
+			t.Errorf("Flow ID %v is not unique", f.ID)
+		}
+		ids[f.ID] = true
+		packets += f.NumPackets
+	}
+	wg.Wait()
+	if len(ids) != 44 || stats.TotalFlows != 44 {
+		t.Errorf("Got %v flows (%v in stats), want 44", len(ids), stats.TotalFlows)
+	}
+	if packets != 478 || stats.TotalPackets != 478 {
+		t.Errorf("Got %v packets in flows (%v in stats), want 478", packets, stats.TotalPackets)
+	}
+}
+
+func TestAssignFlowsShardedMaxFlows(t *testing.T) {
+	var handle *pcap.Handle
+	handle, _ = pcap.OpenOffline("testdata/vlan.pcap")
+	defer handle.Close()
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+	config.FlowWorkers = 4
+	config.MaxFlows = 4
+	defer func() { config.FlowWorkers, config.MaxFlows = 1, 0 }()
+
+	// State
+	stats.TotalFlows = 0
+	stats.NumEvicted = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	// The flows still open at the end are in the workers' caches, which share the limit.
+	open := 0
+	for f := range inFlows {
+		if f.ClosureReason == ClosureEOS {
+			open++
+		}
+	}
+	wg.Wait()
+	if open > 4 {
+		t.Errorf("Got %v open flows at the end, want at most 4", open)
+	}
+	if stats.NumEvicted == 0 {
+		t.Error("No flows were evicted")
+	}
+}
+
+func Example_flow_interimRecords() {
+	var handle *pcap.Handle
+	handle, _ = pcap.OpenOffline("testdata/ssh-session-v4.pcap")
+	defer handle.Close()
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1
+	config.IdleTimeout = 300
+	config.Biflow = true
+	config.InterimRecords = true
+	defer func() { config.Biflow, config.InterimRecords = false, false }()
+
+	// State
+	stats.NumBytes = 0
+	stats.NumDecoded = 0
+	stats.NumTruncated = 0
+	stats.TotalPackets = 0
+	stats.TotalFlows = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for f := range inFlows {
+		fmt.Println(f.String())
+		fmt.Printf("id: %v, sequence: %v, closure: %v, delta (count: %v, bytes: %v, payload_bytes: %v)\n",
+			f.ID, f.Sequence, f.ClosureReason, f.Delta.NumPackets, f.Delta.NumBytes,
+			f.Delta.NumPayloadBytes)
+	}
+	wg.Wait()
+	fmt.Printf("Processed %v packets (%v bytes) in %v flows with %v decoded, and %v truncated.\n",
+		stats.TotalPackets, stats.NumBytes, stats.TotalFlows, stats.NumDecoded, stats.NumTruncated)
+	// Output:
+	// 2009-04-27 21:48:32.78471 - 21:48:33.20409 (419.373ms) TCP 192.168.0.5:1487 -> 192.168.0.7:22 (count: 20, bytes: 4765, payload_bytes: 3633)
+	// id: 1, sequence: 0, closure: 5, delta (count: 20, bytes: 4765, payload_bytes: 3633)
+	// 2009-04-27 21:48:32.78471 - 21:48:44.26865 (11.483939s) TCP 192.168.0.5:1487 -> 192.168.0.7:22 (count: 22, bytes: 4879, payload_bytes: 3633)
+	// id: 1, sequence: 1, closure: 0, delta (count: 2, bytes: 114, payload_bytes: 0)
+	// 2009-04-27 21:48:44.26867 - 21:48:44.26867 (0s) TCP 192.168.0.5:1487 -> 192.168.0.7:22 (count: 1, bytes: 54, payload_bytes: 0)
+	// id: 2, sequence: 0, closure: 3, delta (count: 1, bytes: 54, payload_bytes: 0)
+	// Processed 23 packets (4933 bytes) in 2 flows with 23 decoded, and 0 truncated.
+}
+
+func Example_flow_splt() {
+	var handle *pcap.Handle
+	handle, _ = pcap.OpenOffline("testdata/tcp-complete-v4.pcap")
+	defer handle.Close()
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+	config.Biflow = true
+	config.SPLTLength = 3
+	defer func() { config.Biflow, config.SPLTLength = false, 0 }()
+
+	// State
+	stats.NumBytes = 0
+	stats.NumDecoded = 0
+	stats.NumTruncated = 0
+	stats.TotalPackets = 0
+	stats.TotalFlows = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for f := range inFlows {
+		fmt.Println(f.String())
+		fmt.Printf("splt: %v\n", f.SPLT)
+		sizes := f.Initiator.PacketSizes
+		fmt.Printf("initiator sizes: (min: %v, max: %v, mean: %.2f, stddev: %.2f), histogram: %v\n",
+			sizes.Min, sizes.Max, sizes.Mean, sizes.StdDev, f.Initiator.LengthHistogram)
+	}
+	wg.Wait()
+	// Output:
+	// 2009-04-27 21:00:04.06610 - 21:00:07.17391 (3.107803s) TCP 192.168.0.5:1449 -> 192.168.0.7:2111 (count: 4, bytes: 232, payload_bytes: 0)
+	// splt: [{62 true 0s} {62 false 18.427ms} {54 true 18.47ms}]
+	// initiator sizes: (min: 54, max: 62, mean: 56.67, stddev: 3.77), histogram: [3 0 0 0 0 0 0]
+	// 2009-04-27 21:00:07.17394 - 21:00:07.17394 (0s) TCP 192.168.0.7:2111 -> 192.168.0.5:1449 (count: 1, bytes: 60, payload_bytes: 0)
+	// splt: [{60 true 0s}]
+	// initiator sizes: (min: 60, max: 60, mean: 60.00, stddev: 0.00), histogram: [1 0 0 0 0 0 0]
+}
+
+func Example_flow_qinq() {
+	var handle *pcap.Handle
+	handle, _ = pcap.OpenOffline("testdata/qinq.pcap")
+	defer handle.Close()
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for flow := range inFlows {
+		fmt.Printf("%s VLAN %d outer VLAN %d (count: %d)\n", flow.Key.String(), flow.Key.VlanID,
+			flow.Key.OuterVlanID, flow.NumPackets)
+	}
+	wg.Wait()
+	// Output:
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000 VLAN 100 outer VLAN 20 (count: 1)
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000 VLAN 100 outer VLAN 0 (count: 1)
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000 VLAN 100 outer VLAN 10 (count: 2)
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000 VLAN 100 outer VLAN 30 (count: 1)
+}
@@ -0,0 +1,236 @@
+// This source code is covered by the license found in the LICENSE file.
+
+// Package flowcache combines a hash map and a pick-queue to track sessions, such as network
+// flows, DNS transactions, or application sessions, that terminate after an idle timeout.  A
+// Cache holds values of any type under comparable keys.  Callers supply the hash of each key,
+// so the key type decides how it is hashed, and a lookup always confirms the full key, so keys
+// with colliding hashes never share a value.
+//
+// Values may use different idle timeouts.  The cache keeps a small set of idle queues, each in
+// expiry order, and adds each value to the queue with the latest expiry that is not after its
+// own.  The number of queues stays close to the number of distinct idle timeouts in use.
+//
+// A Cache is not safe for concurrent use, but it has no shared state, so each goroutine can own
+// its own Cache.  Use a SyncCache to share one cache between goroutines.
+package flowcache
+
+import (
+	"sync"
+	"time"
+)
+
+// scratch holds variables reused by several Cache methods to avoid allocation and GC.
+type scratch[K comparable, V any] struct {
+	e    *entry[K, V]
+	prev *entry[K, V]
+	q    *PickQueue[K]
+	key  K
+	hash uint64
+}
+
+// entry holds a value and pointers to the PickQueue and node that hold its idle time.  This
+// gives us an efficient way to delete from the idle queue when a value is removed directly from
+// the hashmap.  Entries whose keys hash to the same value are chained through next.
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+	queue *PickQueue[K]
+	iptr  *PickNode[K]
+	next  *entry[K, V]
+}
+
+// Cache combines a hash map and a pick-queue to provide an efficient way to terminate values
+// based on idle timeouts.  We fix the capacity and let the caller evict the values earliest
+// to expire if it exhausts resources.  The map is keyed by the caller's hash of each key
+// and each map entry is a chain of entries with that hash.
+type Cache[K comparable, V any] struct {
+	entries    map[uint64]*entry[K, V]
+	idle       []*PickQueue[K]
+	nodes      *sync.Pool
+	capacity   uint
+	length     uint
+	collisions uint64
+	pool       *sync.Pool
+	v          scratch[K, V]
+}
+
+// New returns a pointer to an initialized Cache with the given capacity.  Zero capacity means
+// the cache is unbounded.
+func New[K comparable, V any](capacity uint) *Cache[K, V] {
+	return &Cache[K, V]{entries: make(map[uint64]*entry[K, V], capacity),
+		nodes:    &sync.Pool{New: func() interface{} { return &PickNode[K]{} }},
+		capacity: capacity, pool: &sync.Pool{New: func() interface{} { return &entry[K, V]{} }}}
+}
+
+// pushIdle adds key to the idle queue with the latest expiry that is not after idle, so every
+// queue stays in expiry order, and records the queue and node in e.  It starts a new queue if
+// idle is earlier than the back of every queue.
+func (c *Cache[K, V]) pushIdle(e *entry[K, V], key K, hash uint64, idle time.Time) {
+	e.queue = nil
+	for _, q := range c.idle {
+		if !q.InPtr.expiry.After(idle) && (e.queue == nil || q.InPtr.expiry.After(e.queue.InPtr.expiry)) {
+			e.queue = q
+		}
+	}
+	if e.queue == nil {
+		e.queue = &PickQueue[K]{pool: c.nodes}
+		c.idle = append(c.idle, e.queue)
+	}
+	e.iptr = e.queue.PushIn(key, hash, idle)
+}
+
+// pickIdle removes the idle queue node of e and drops its queue if the queue is now empty.
+func (c *Cache[K, V]) pickIdle(e *entry[K, V]) {
+	e.queue.Pick(e.iptr)
+	if e.queue.Len() > 0 {
+		return
+	}
+	for i, q := range c.idle {
+		if q == e.queue {
+			c.idle[i] = c.idle[len(c.idle)-1]
+			c.idle[len(c.idle)-1] = nil
+			c.idle = c.idle[:len(c.idle)-1]
+			break
+		}
+	}
+}
+
+// oldest returns the idle queue whose front node expires first, or nil if the cache is empty.
+func (c *Cache[K, V]) oldest() (oldest *PickQueue[K]) {
+	for _, q := range c.idle {
+		if oldest == nil || q.OutPtr.expiry.Before(oldest.OutPtr.expiry) {
+			oldest = q
+		}
+	}
+	return
+}
+
+// find returns the entry for key in the chain for hash and the entry before it in the chain.
+// The entry is nil if the key is not in the cache.
+func (c *Cache[K, V]) find(key K, hash uint64) (e *entry[K, V], prev *entry[K, V]) {
+	for e = c.entries[hash]; e != nil; prev, e = e, e.next {
+		if e.key == key {
+			return e, prev
+		}
+	}
+	return nil, nil
+}
+
+// Insert inserts a new value and its idle timeout and returns true if the key doesn't exist in
+// the cache.  It returns false if the key already exists in the cache.  If another key with the
+// same hash is already in the cache, the new value is chained behind it and we count a
+// collision.
+func (c *Cache[K, V]) Insert(value V, key K, hash uint64, idle time.Time) bool {
+	if c.v.e, _ = c.find(key, hash); c.v.e != nil {
+		return false // Key is already in hashmap, so don't enter and return false
+	}
+	c.v.e = c.pool.Get().(*entry[K, V])
+	c.v.e.key = key
+	c.v.e.value = value
+	c.pushIdle(c.v.e, key, hash, idle)
+	c.v.e.next = c.entries[hash]
+	if c.v.e.next != nil {
+		c.collisions++
+	}
+	c.entries[hash] = c.v.e
+	c.length++
+	return true
+}
+
+// Update updates a value and its idle timeout, and returns true if the key exists in the cache.
+// It returns false if the key is not in the cache.
+func (c *Cache[K, V]) Update(value V, key K, hash uint64, idle time.Time) bool {
+	if c.v.e, _ = c.find(key, hash); c.v.e == nil {
+		return false // Key is not in hashmap, so nothing to update and return false
+	}
+	c.pickIdle(c.v.e)
+	c.v.e.value = value
+	c.pushIdle(c.v.e, key, hash, idle)
+	return true
+}
+
+// Remove removes a value and its idle timeout from the cache. Return true if the key was in the
+// cache and removed; false otherwise.
+func (c *Cache[K, V]) Remove(key K, hash uint64) (ok bool) {
+	if c.v.e, c.v.prev = c.find(key, hash); c.v.e == nil {
+		return false
+	}
+	if c.v.prev == nil {
+		if c.v.e.next == nil {
+			delete(c.entries, hash)
+		} else {
+			c.entries[hash] = c.v.e.next
+		}
+	} else {
+		c.v.prev.next = c.v.e.next
+	}
+	c.pickIdle(c.v.e)
+	*c.v.e = entry[K, V]{}
+	c.pool.Put(c.v.e)
+	c.length--
+	return true
+}
+
+// Fetch retrieves a value from the cache based on a key but it does not remove the value.  This
+// function can be used to check if a key is already in the cache by checking the return value
+// of ok.
+func (c *Cache[K, V]) Fetch(key K, hash uint64) (value V, ok bool) {
+	if c.v.e, _ = c.find(key, hash); c.v.e == nil {
+		return value, false
+	}
+	return c.v.e.value, true
+}
+
+// Len returns the number of values in the cache.
+func (c *Cache[K, V]) Len() uint {
+	return c.length
+}
+
+// Full returns true if the cache holds its capacity of values.  A cache with zero capacity is
+// never full.
+func (c *Cache[K, V]) Full() bool {
+	return c.capacity > 0 && c.length >= c.capacity
+}
+
+// Collisions returns the number of keys that were inserted with the same hash value as a
+// different key already in the cache.
+func (c *Cache[K, V]) Collisions() uint64 {
+	return c.collisions
+}
+
+// Evict removes up to n of the values earliest to expire from the cache and applies the
+// callback function to each value.  These are the values at the front of the idle queues, i.e.
+// the ones closest to an idle timeout.  With a single idle timeout they are also the least
+// recently active values; with mixed timeouts a value with a short timeout goes first even if
+// another value has been idle for longer.
+func (c *Cache[K, V]) Evict(n int, cb func(V)) (count int) {
+	for c.v.q = c.oldest(); c.v.q != nil && count < n; c.v.q = c.oldest() {
+		c.expire(c.v.q.OutPtr, cb)
+		count++
+	}
+	return
+}
+
+// Purge cycles through the idle queues, removes values that have expired, and applies the
+// callback function to each value in expiry order.
+func (c *Cache[K, V]) Purge(t time.Time, cb func(V)) (count int) {
+	for c.v.q = c.oldest(); c.v.q != nil; c.v.q = c.oldest() {
+		if c.v.q.OutPtr.expiry.After(t) {
+			// Each queue is in expiry order, so no other value has expired either.
+			return
+		}
+		c.expire(c.v.q.OutPtr, cb)
+		count++
+	}
+	return
+}
+
+// expire applies the callback to the value of an idle queue node and removes the value.
+func (c *Cache[K, V]) expire(pn *PickNode[K], cb func(V)) {
+	c.v.key = pn.key
+	c.v.hash = pn.hash
+	if c.v.e, _ = c.find(c.v.key, c.v.hash); c.v.e != nil {
+		cb(c.v.e.value)
+	}
+	c.Remove(c.v.key, c.v.hash)
+}
@@ -0,0 +1,174 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package flowcache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Testing
+
+type testKey struct {
+	addr string
+	port uint16
+}
+
+func TestCacheCollisions(t *testing.T) {
+	var (
+		now   = time.Unix(0, 0)
+		hash  = uint64(42) // Force both keys into the same bucket
+		keyA  = testKey{"10.0.0.1", 80}
+		keyB  = testKey{"10.0.0.2", 80}
+		cache = New[testKey, int](16)
+	)
+
+	if !cache.Insert(1, keyA, hash, now.Add(time.Second)) {
+		t.Fatal("Insert of the first key failed")
+	}
+	if !cache.Insert(2, keyB, hash, now.Add(2*time.Second)) {
+		t.Fatal("Insert of a colliding key failed")
+	}
+	if cache.Insert(3, keyA, hash, now) {
+		t.Fatal("Insert of a duplicate key succeeded")
+	}
+	if n := cache.Collisions(); n != 1 {
+		t.Fatalf("Collisions() = %v, want 1", n)
+	}
+
+	if value, ok := cache.Fetch(keyA, hash); !ok || value != 1 {
+		t.Errorf("Fetch(keyA) = %v, %v, want 1", value, ok)
+	}
+	if value, ok := cache.Fetch(keyB, hash); !ok || value != 2 {
+		t.Errorf("Fetch(keyB) = %v, %v, want 2", value, ok)
+	}
+
+	if !cache.Update(10, keyA, hash, now.Add(3*time.Second)) {
+		t.Fatal("Update of keyA failed")
+	}
+	if !cache.Remove(keyB, hash) {
+		t.Fatal("Remove of keyB failed")
+	}
+	if _, ok := cache.Fetch(keyB, hash); ok {
+		t.Error("Fetch found keyB after it was removed")
+	}
+	if value, ok := cache.Fetch(keyA, hash); !ok || value != 10 {
+		t.Errorf("Fetch(keyA) after removing keyB = %v, %v, want 10", value, ok)
+	}
+
+	var purged []int
+	cache.Purge(now.Add(time.Hour), func(value int) { purged = append(purged, value) })
+	if len(purged) != 1 || purged[0] != 10 {
+		t.Errorf("Purge returned values %v, want [10]", purged)
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Len() = %v after Purge, want 0", cache.Len())
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	var (
+		now     = time.Unix(0, 0)
+		cache   = New[testKey, int](2)
+		evicted []int
+	)
+	cache.Insert(1, testKey{"10.0.0.1", 1}, 1, now.Add(time.Second))
+	cache.Insert(2, testKey{"10.0.0.1", 2}, 2, now.Add(2*time.Second))
+	if !cache.Full() {
+		t.Fatalf("Full() = false with %v of 2 values", cache.Len())
+	}
+
+	// Touch the first value so the second becomes the least recently active.
+	cache.Update(1, testKey{"10.0.0.1", 1}, 1, now.Add(3*time.Second))
+
+	if n := cache.Evict(1, func(value int) { evicted = append(evicted, value) }); n != 1 {
+		t.Fatalf("Evict(1) = %v, want 1", n)
+	}
+	if len(evicted) != 1 || evicted[0] != 2 {
+		t.Errorf("Evict returned values %v, want [2]", evicted)
+	}
+	if cache.Full() || cache.Len() != 1 {
+		t.Errorf("Len() = %v after eviction, want 1", cache.Len())
+	}
+	if New[testKey, int](0).Full() {
+		t.Error("A cache with zero capacity is full")
+	}
+}
+
+func TestCacheIndependence(t *testing.T) {
+	// Two caches in different goroutines must not share any state.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cache := New[int, int](0)
+			now := time.Unix(0, 0)
+			for j := 0; j < 1000; j++ {
+				cache.Insert(i*j, j, uint64(j%7), now.Add(time.Duration(j)))
+			}
+			for j := 0; j < 1000; j++ {
+				if value, ok := cache.Fetch(j, uint64(j%7)); !ok || value != i*j {
+					t.Errorf("Cache %v: Fetch(%v) = %v, %v, want %v", i, j, value, ok, i*j)
+					return
+				}
+			}
+			if n := cache.Purge(now.Add(time.Hour), func(int) {}); n != 1000 {
+				t.Errorf("Cache %v: Purge() = %v, want 1000", i, n)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSyncCache(t *testing.T) {
+	var (
+		wg    sync.WaitGroup
+		cache = NewSync[int, int](0)
+		now   = time.Unix(0, 0)
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i * 1000; j < (i+1)*1000; j++ {
+				cache.Insert(j, j, uint64(j%7), now.Add(time.Duration(j)))
+				cache.Update(j+1, j, uint64(j%7), now.Add(time.Duration(j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if cache.Len() != 4000 {
+		t.Errorf("Len() = %v, want 4000", cache.Len())
+	}
+	if value, ok := cache.Fetch(1234, 1234%7); !ok || value != 1235 {
+		t.Errorf("Fetch(1234) = %v, %v, want 1235", value, ok)
+	}
+}
+
+func TestCacheMixedTimeouts(t *testing.T) {
+	var (
+		now    = time.Unix(0, 0)
+		cache  = New[testKey, int](0)
+		purged []int
+	)
+	// A long timeout followed by a short one must not hide the short one behind the long one.
+	cache.Insert(1, testKey{"ssh", 22}, 1, now.Add(300*time.Second))
+	cache.Insert(2, testKey{"dns", 53}, 2, now.Add(31*time.Second))
+	cache.Insert(3, testKey{"ssh", 2222}, 3, now.Add(302*time.Second))
+	cache.Insert(4, testKey{"dns", 5353}, 4, now.Add(33*time.Second))
+
+	cache.Purge(now.Add(40*time.Second), func(value int) { purged = append(purged, value) })
+	if len(purged) != 2 || purged[0] != 2 || purged[1] != 4 {
+		t.Errorf("Purge at 40s returned values %v, want [2 4]", purged)
+	}
+	purged = purged[:0]
+	cache.Purge(now.Add(time.Hour), func(value int) { purged = append(purged, value) })
+	if len(purged) != 2 || purged[0] != 1 || purged[1] != 3 {
+		t.Errorf("Purge at 1h returned values %v, want [1 3]", purged)
+	}
+	if len(cache.idle) != 0 {
+		t.Errorf("Cache has %v idle queues after purging everything, want 0", len(cache.idle))
+	}
+}
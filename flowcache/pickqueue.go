@@ -0,0 +1,105 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package flowcache
+
+import (
+	"sync"
+	"time"
+)
+
+// PickNode is a node in a PickQueue.  Each node has a key and its hash into a hashmap and an
+// expiry time at which the value for the key is considered terminated.
+type PickNode[K comparable] struct {
+	next   *PickNode[K]
+	prev   *PickNode[K]
+	key    K
+	hash   uint64
+	expiry time.Time
+}
+
+// NewPickQueue returns a new PickQueue
+func NewPickQueue[K comparable]() *PickQueue[K] {
+	return &PickQueue[K]{OutPtr: nil, InPtr: nil,
+		pool: &sync.Pool{New: func() interface{} { return &PickNode[K]{} }}}
+}
+
+// PickQueue is a queue with elements that can be removed ("picked") from any point in the queue,
+// not just the front.  Elements can only be added at the front or (normally) back.  A pick queue
+// combined with a hashmap with pointers to queue elements implements idle timeouts for flows.
+// The fields of PickNode hold context necessary for enqueuing and dequeuing elements; the queue
+// has no such logic embedded in its receiver methods.
+type PickQueue[K comparable] struct {
+	OutPtr *PickNode[K]
+	InPtr  *PickNode[K]
+	length uint
+	pool   *sync.Pool
+}
+
+// PushIn enqueues a node at the back of a PickQueue with values key, hash, and expiry and returns a
+// pointer to the node for reference (presumably in a hashmap).  Nodes are allocated from a
+// sync.Pool, which helps manage the heap and GC. If the GC becomes a chokepoint, then we should
+// look at a slab allocator for nodes.
+func (pq *PickQueue[K]) PushIn(key K, hash uint64, expiry time.Time) *PickNode[K] {
+	pn := pq.pool.Get().(*PickNode[K])
+	pn.key = key
+	pn.hash = hash
+	pn.expiry = expiry
+	pn.next = nil
+	pn.prev = nil
+
+	if pq.InPtr == nil {
+		pq.OutPtr = pn
+	} else {
+		pq.InPtr.next = pn
+	}
+	pn.prev = pq.InPtr
+	pq.InPtr = pn
+	pq.length++
+	return pn
+}
+
+// PopOut returns the key and hash values of the head element in the PickQueue unless the queue
+// is empty.  Also, it returns true is the queue was head-popped and false if the queue was empty.
+func (pq *PickQueue[K]) PopOut() (key K, hash uint64, ok bool) {
+	pn := pq.OutPtr
+	if pn == nil {
+		return key, 0, false
+	}
+	key, hash = pn.key, pn.hash
+	pq.Pick(pn)
+	return key, hash, true
+}
+
+// Len returns the number of nodes in the PickQueue.
+func (pq *PickQueue[K]) Len() uint {
+	return pq.length
+}
+
+// Pick removes a node from the PickQueue and returns the node to the sync.Pool.  We assume the
+// node is an element of the PickQueue (i.e. we don't check membership).
+func (pq *PickQueue[K]) Pick(pn *PickNode[K]) {
+	// Only allow picking a double nil node if it is the only node in the list
+	if pn.next == nil && pn.prev == nil && !(pq.OutPtr == pn && pq.InPtr == pn) {
+		return
+	}
+
+	// Connect prev pointer to next pointer
+	if pn.prev == nil {
+		pq.OutPtr = pn.next
+	} else {
+		pn.prev.next = pn.next
+	}
+
+	// Connect next pointer to prev pointer
+	if pn.next == nil {
+		pq.InPtr = pn.prev
+	} else {
+		pn.next.prev = pn.prev
+	}
+
+	// Release the node back to the pool
+	var zero K
+	pn.key = zero
+	pq.pool.Put(pn)
+	pq.length--
+}
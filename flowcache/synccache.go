@@ -0,0 +1,85 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package flowcache
+
+import (
+	"sync"
+	"time"
+)
+
+// SyncCache is a Cache that is safe for concurrent use by multiple goroutines.  Every method
+// holds a mutex for its duration, including the callbacks of Purge and Evict, so callbacks must
+// not call back into the SyncCache.
+type SyncCache[K comparable, V any] struct {
+	mu    sync.Mutex
+	cache *Cache[K, V]
+}
+
+// NewSync returns a pointer to an initialized SyncCache with the given capacity.  Zero capacity
+// means the cache is unbounded.
+func NewSync[K comparable, V any](capacity uint) *SyncCache[K, V] {
+	return &SyncCache[K, V]{cache: New[K, V](capacity)}
+}
+
+// Insert is the synchronized version of Cache.Insert.
+func (s *SyncCache[K, V]) Insert(value V, key K, hash uint64, idle time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache.Insert(value, key, hash, idle)
+}
+
+// Update is the synchronized version of Cache.Update.
+func (s *SyncCache[K, V]) Update(value V, key K, hash uint64, idle time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache.Update(value, key, hash, idle)
+}
+
+// Remove is the synchronized version of Cache.Remove.
+func (s *SyncCache[K, V]) Remove(key K, hash uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache.Remove(key, hash)
+}
+
+// Fetch is the synchronized version of Cache.Fetch.
+func (s *SyncCache[K, V]) Fetch(key K, hash uint64) (V, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache.Fetch(key, hash)
+}
+
+// Len is the synchronized version of Cache.Len.
+func (s *SyncCache[K, V]) Len() uint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache.Len()
+}
+
+// Full is the synchronized version of Cache.Full.
+func (s *SyncCache[K, V]) Full() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache.Full()
+}
+
+// Collisions is the synchronized version of Cache.Collisions.
+func (s *SyncCache[K, V]) Collisions() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache.Collisions()
+}
+
+// Evict is the synchronized version of Cache.Evict.
+func (s *SyncCache[K, V]) Evict(n int, cb func(V)) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache.Evict(n, cb)
+}
+
+// Purge is the synchronized version of Cache.Purge.
+func (s *SyncCache[K, V]) Purge(t time.Time, cb func(V)) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cache.Purge(t, cb)
+}
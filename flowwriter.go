@@ -27,29 +27,46 @@ func WriteFlows(done <-chan struct{}, in <-chan Flow) {
 		}
 		filename := config.OutputPrefix + "flow" + config.OutputSlug + ".json"
 		l := &lumberjack.Logger{Filename: filename, MaxSize: 100, MaxAge: 1}
-		ticker := time.NewTicker(time.Duration(config.OutputRotationInterval) * time.Minute).C
+		rotation := rotation{interval: time.Duration(config.OutputRotationInterval) * time.Minute}
+		// With output windows, flows go to the file of the window they ended in instead.
+		var windows *WindowWriter
+		if config.OutputWindow > 0 {
+			windows = NewWindowWriter(config.OutputPrefix+"flow"+config.OutputSlug, ".json",
+				time.Duration(config.OutputWindow)*time.Minute)
+		}
 
 	Loop:
 		for f := range in {
 			select {
 			case <-done:
 				break Loop
-			case <-ticker:
-				l.Rotate() // Rotate the log file based on `config.OutputRotationInterval`.
 			default:
-				b, err := json.Marshal(f)
-				if err != nil {
-					// TODO: Better error handling here.
-					log.Println("Cannot convert flow to JSON: ", f.String()) // Could go to lumberjack error log
-					continue
+			}
+			if windows == nil && rotation.due() {
+				l.Rotate() // Rotate the log file based on `config.OutputRotationInterval`.
+			}
+			b, err := json.Marshal(f)
+			if err != nil {
+				// TODO: Better error handling here.
+				log.Println("Cannot convert flow to JSON: ", f.String()) // Could go to lumberjack error log
+				continue
+			}
+			if windows != nil {
+				if err = windows.Write(f.EndTime, b); err != nil {
+					log.Println("Cannot write flow: ", err)
 				}
-				l.Write(b)
+				continue
 			}
+			l.Write(b)
+		}
+		if windows != nil {
+			windows.Close()
+		} else {
+			// Force a timestamp on the last rotated file and delete the resulting empty flow.json file.
+			l.Rotate()
+			os.Remove(filename)
+			l.Close()
 		}
-		// Force a timestamp on the last rotated file and delete the resulting empty flow.json file.
-		l.Rotate()
-		os.Remove(filename)
-		l.Close()
 		wg.Done()
 	}()
 }
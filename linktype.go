@@ -0,0 +1,111 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Link types that gopacket doesn't name.  LinkType is a byte, so handles report the Linux cooked
+// capture v2 link type, 276, truncated to 20.
+const (
+	linkTypeIEEE80211 layers.LinkType = 105       // 802.11 without radiotap
+	linkTypeLinuxSLL2 layers.LinkType = 276 % 256 // Linux cooked capture v2, e.g. tcpdump -i any
+)
+
+// Layer types for link types that gopacket doesn't decode with a DecodingLayer.  Layer types up
+// to 1000 are reserved for gopacket.
+var (
+	layerTypeRawIP = gopacket.RegisterLayerType(1501,
+		gopacket.LayerTypeMetadata{Name: "RawIP", Decoder: gopacket.DecodePayload})
+	layerTypeLinuxSLL2 = gopacket.RegisterLayerType(1502,
+		gopacket.LayerTypeMetadata{Name: "LinuxSLL2", Decoder: gopacket.DecodePayload})
+)
+
+// firstLayerType returns the layer type that packets of a link type start with.
+func firstLayerType(linkType layers.LinkType) (gopacket.LayerType, error) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return layers.LayerTypeEthernet, nil
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback, nil
+	case layers.LinkTypeRaw:
+		return layerTypeRawIP, nil
+	case layers.LinkTypeIPv4:
+		return layers.LayerTypeIPv4, nil
+	case layers.LinkTypeIPv6:
+		return layers.LayerTypeIPv6, nil
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL, nil
+	case linkTypeLinuxSLL2:
+		return layerTypeLinuxSLL2, nil
+	case layers.LinkTypeIEEE80211Radio:
+		return layers.LayerTypeRadioTap, nil
+	case linkTypeIEEE80211:
+		return layers.LayerTypeDot11, nil
+	}
+	return gopacket.LayerTypeZero, fmt.Errorf("unsupported link type %v", linkType)
+}
+
+// rawIP decodes the empty link layer of raw IP packets, which are IPv4 or IPv6 depending on
+// their version.
+type rawIP struct {
+	layers.BaseLayer
+}
+
+// DecodeFromBytes passes all of data on to the IP layer.
+func (r *rawIP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) == 0 {
+		df.SetTruncated()
+		return fmt.Errorf("Empty raw IP packet")
+	}
+	r.BaseLayer = layers.BaseLayer{Contents: data[:0], Payload: data}
+	return nil
+}
+
+// CanDecode returns the raw IP layer type.
+func (r *rawIP) CanDecode() gopacket.LayerClass {
+	return layerTypeRawIP
+}
+
+// NextLayerType returns IPv4 or IPv6.
+func (r *rawIP) NextLayerType() gopacket.LayerType {
+	switch r.Payload[0] >> 4 {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	}
+	return gopacket.LayerTypeZero
+}
+
+// linuxSLL2 decodes the Linux cooked capture v2 header.
+type linuxSLL2 struct {
+	layers.BaseLayer
+	protocol layers.EthernetType
+}
+
+// DecodeFromBytes decodes the 20 byte header.
+func (sll *linuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 20 {
+		df.SetTruncated()
+		return fmt.Errorf("Linux SLL2 length %d less than 20", len(data))
+	}
+	sll.protocol = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	sll.BaseLayer = layers.BaseLayer{Contents: data[:20], Payload: data[20:]}
+	return nil
+}
+
+// CanDecode returns the Linux SLL2 layer type.
+func (sll *linuxSLL2) CanDecode() gopacket.LayerClass {
+	return layerTypeLinuxSLL2
+}
+
+// NextLayerType returns the layer type of the protocol.
+func (sll *linuxSLL2) NextLayerType() gopacket.LayerType {
+	return sll.protocol.LayerType()
+}
@@ -0,0 +1,82 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Testing
+
+func TestFirstLayerType(t *testing.T) {
+	tests := []struct {
+		linkType layers.LinkType
+		want     gopacket.LayerType
+	}{
+		{layers.LinkTypeEthernet, layers.LayerTypeEthernet},
+		{layers.LinkTypeNull, layers.LayerTypeLoopback},
+		{layers.LinkTypeLoop, layers.LayerTypeLoopback},
+		{layers.LinkTypeRaw, layerTypeRawIP},
+		{layers.LinkTypeIPv4, layers.LayerTypeIPv4},
+		{layers.LinkTypeIPv6, layers.LayerTypeIPv6},
+		{layers.LinkTypeLinuxSLL, layers.LayerTypeLinuxSLL},
+		{linkTypeLinuxSLL2, layerTypeLinuxSLL2},
+		{layers.LinkTypeIEEE80211Radio, layers.LayerTypeRadioTap},
+		{linkTypeIEEE80211, layers.LayerTypeDot11},
+	}
+	for _, test := range tests {
+		got, err := firstLayerType(test.linkType)
+		if err != nil || got != test.want {
+			t.Errorf("firstLayerType(%v) = %v, %v; want %v", test.linkType, got, err, test.want)
+		}
+	}
+	if _, err := firstLayerType(layers.LinkTypeFDDI); err == nil {
+		t.Errorf("firstLayerType(%v) succeeded", layers.LinkTypeFDDI)
+	}
+}
+
+func TestLinuxSLL2(t *testing.T) {
+	header := []byte{
+		0x86, 0xdd, 0, 0, // Protocol, reserved
+		0, 0, 0, 2, // Interface index
+		0, 1, 0, 6, // ARPHRD type, packet type, address length
+		0, 0, 0, 0, 0, 1, 0, 0, // Address
+	}
+	ip6 := []byte{0x60, 0, 0, 0}
+	var sll linuxSLL2
+	if err := sll.DecodeFromBytes(append(header, ip6...), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if sll.NextLayerType() != layers.LayerTypeIPv6 || len(sll.Payload) != len(ip6) {
+		t.Errorf("got %v with %d byte payload; want IPv6 with %d", sll.NextLayerType(),
+			len(sll.Payload), len(ip6))
+	}
+	if err := sll.DecodeFromBytes(header[:19], gopacket.NilDecodeFeedback); err == nil {
+		t.Error("decoded a truncated header")
+	}
+}
+
+func TestRawIP(t *testing.T) {
+	var raw rawIP
+	for _, test := range []struct {
+		data []byte
+		want gopacket.LayerType
+	}{
+		{[]byte{0x45, 0}, layers.LayerTypeIPv4},
+		{[]byte{0x60, 0}, layers.LayerTypeIPv6},
+		{[]byte{0x10, 0}, gopacket.LayerTypeZero},
+	} {
+		if err := raw.DecodeFromBytes(test.data, gopacket.NilDecodeFeedback); err != nil {
+			t.Fatal(err)
+		}
+		if got := raw.NextLayerType(); got != test.want {
+			t.Errorf("version %d: got %v, want %v", test.data[0]>>4, got, test.want)
+		}
+	}
+	if err := raw.DecodeFromBytes(nil, gopacket.NilDecodeFeedback); err == nil {
+		t.Error("decoded an empty packet")
+	}
+}
@@ -1,7 +1,7 @@
 // This source code is covered by the license found in the LICENSE file.
 //
-// Ing is a packet processor and metadata collector based on gopacket.  It reads packets from a
-// PCAP file or a live network device.
+// Ing is a packet processor and metadata collector based on gopacket.  It reads packets from
+// PCAP or PCAPNG files or live network devices.
 
 package main
 
@@ -9,11 +9,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"sync"
 	"time"
-
-	"github.com/google/gopacket/pcap"
 )
 
 // Build variables
@@ -25,17 +24,36 @@ var (
 
 // Config groups global configuration values.
 var config struct {
-	ActiveTimeout          uint   // Duration in seconds for active flow terminations
-	IdleTimeout            uint   // Duration in seconds for terminating inactive flows
-	IdlePacketDuration     int    // Number of packets to skip before checking for idle timeouts
-	OutputPrefix           string // Path to output files
-	OutputRotationInterval uint   // Rotational interval for output files
-	OutputSlug             string // Slug for output files
-	PcapTimeout            int    // Configures the pcap handler for packet buffering in milliseconds
-	SnapLen                int    // Number of packet bytes to capture
-	FilterTCPFlags         bool   // Drop and report packets with abnormal TCP flag combinations
-	FilterSmallFlows       bool   // Filter out small TCP flows with 1-3 packets
-	BannerTermsFile        string // File containing banner search terms
+	ActiveTimeout          uint    // Duration in seconds for active flow terminations
+	IdleTimeout            uint    // Duration in seconds for terminating inactive flows
+	TimeoutPolicyFile      string  // File containing per-protocol, per-port, and per-state timeouts
+	InterimRecords         bool    // Emit interim records at the active timeout instead of closing flows
+	IdlePacketDuration     int     // Number of packets to skip before checking for idle timeouts
+	MaxFlows               uint    // Maximum number of active flows before evicting the earliest to expire
+	FlowWorkers            uint    // Number of flow table workers (shards) assigning packets to flows
+	OutputPrefix           string  // Path to output files
+	OutputRotationInterval uint    // Rotational interval for output files
+	OutputWindow           uint    // Minutes of flow and banner time in each output file
+	OutputSlug             string  // Slug for output files
+	StatsInterval          uint    // Minutes between reports of live capture statistics
+	PcapTimeout            int     // Configures the pcap handler for packet buffering in milliseconds
+	SnapLen                int     // Number of packet bytes to capture
+	FilterTCPFlags         bool    // Drop and report packets with abnormal TCP flag combinations
+	FilterSmallFlows       bool    // Filter out small TCP flows with 1-3 packets
+	BannerTermsFile        string  // File containing banner search terms
+	ErrorPcap              bool    // Write undecodable packets to a pcap file in the output directory
+	Biflow                 bool    // Merge both directions of a conversation into one flow
+	SPLTLength             uint    // Number of packet lengths and times to record at the start of a flow
+	CommunityIDSeed        uint    // Seed for Community ID flow hashes
+	FragmentTimeout        uint    // Duration in seconds to wait for the fragments of a packet
+	FragmentMemory         uint    // Megabytes of fragments to buffer for reassembly
+	Decapsulate            string  // Comma separated tunnels to decapsulate
+	ReplaySpeed            float64 // Multiple of the original speed to replay offline packets at
+	PacketClock            bool    // Rotate output files by packet time instead of wall time
+	AFPacket               bool    // Capture from devices with AF_PACKET sockets instead of libpcap
+	AFPacketBlockSize      uint    // Kilobytes in each block of an AF_PACKET ring
+	AFPacketBlocks         uint    // Number of blocks in each AF_PACKET ring
+	AFPacketFanout         uint    // Number of AF_PACKET sockets and readers per device
 	Debug                  struct {
 		DropOutput   bool // Drop all output; useful for performance profiling
 		PrintBanners bool // Print every banner in short form
@@ -48,26 +66,48 @@ var config struct {
 var wg sync.WaitGroup
 
 func main() {
-	var packetHandle *pcap.Handle
+	var packetSource PacketSource
 	var err error
 
 	// Since these flags are local to this function, i.e. setting up a PCAP handle, we don't need
 	// them as global configuration variables.
-	bpf := flag.String("bpf", "", "Berkeley Packet Filter expression")
-	isDevice := flag.Bool("device", false, "INPUT is a live network device")
+	bpf := flag.String("bpf", "", "Berkeley Packet Filter expression, applied to every device")
+	isDevice := flag.Bool("device", false, "INPUT is one or more live network devices")
+	watch := flag.Bool("watch", false, "INPUT is a spool directory to watch for new capture files")
+	watchCheckpoint := flag.String("watch-checkpoint", "", "Checkpoint file of --watch progress (default INPUT/.ing-checkpoint)")
+	watchAfter := flag.String("watch-after", "keep", "What --watch does with processed files: keep, delete, or move them to a directory")
 	showVersion := flag.Bool("version", false, "Show version information and exit")
 	config.PcapTimeout = 10
 
 	// These are global configuration variables, so we need to call XyzVar().
 	flag.UintVar(&config.ActiveTimeout, "active-timeout", 1800, "Active flow timeout in seconds")
 	flag.UintVar(&config.IdleTimeout, "idle-timeout", 300, "Idle flow timout in seconds")
+	flag.StringVar(&config.TimeoutPolicyFile, "timeout-policy", "", "Path to JSON file of per-protocol and per-port timeouts")
+	flag.BoolVar(&config.InterimRecords, "interim-records", false, "Emit interim flow records at the active timeout and keep the flow open")
+	flag.UintVar(&config.MaxFlows, "max-flows", 10000000, "Maximum number of active flows, evicting the earliest to expire when full (0 for no limit)")
+	flag.UintVar(&config.FlowWorkers, "flow-workers", 1, "Number of flow table workers to spread flows across cores")
 	flag.StringVar(&config.OutputPrefix, "output-prefix", "./output/", "Path to output files")
 	flag.UintVar(&config.OutputRotationInterval, "output-interval", 10, "Output rotation interval in minutes")
+	flag.UintVar(&config.OutputWindow, "output-window", 0, "Write output to files of fixed N minute windows of flow end and banner times")
 	flag.StringVar(&config.OutputSlug, "output-slug", "-ing", "Output file slug")
+	flag.UintVar(&config.StatsInterval, "stats-interval", 1, "Report live capture drops every N minutes (0 for only at the end)")
 	flag.IntVar(&config.SnapLen, "snaplen", 65536, "Read snaplen bytes from each packet")
 	flag.BoolVar(&config.FilterTCPFlags, "filter-tcp-flags", false, "Drop and report suspicious TCP flag combinations")
 	flag.BoolVar(&config.FilterSmallFlows, "filter-small-flows", false, "Don't output TCP flows with 1-3 packets")
+	flag.BoolVar(&config.ErrorPcap, "error-pcap", false, "Write undecodable packets to a rotating pcap file with the output")
 	flag.StringVar(&config.BannerTermsFile, "banner-terms", "./banner-terms.json", "Path to JSON file of banner terms")
+	flag.BoolVar(&config.Biflow, "biflow", false, "Merge both directions of a conversation into one bidirectional flow")
+	flag.UintVar(&config.SPLTLength, "splt-length", 0, "Record the lengths and times of the first N packets of each flow")
+	flag.UintVar(&config.CommunityIDSeed, "community-id-seed", 0, "Seed for Community ID flow hashes (0 to 65535)")
+	flag.UintVar(&config.FragmentTimeout, "frag-timeout", 30, "Seconds to wait for all fragments of an IP packet")
+	flag.UintVar(&config.FragmentMemory, "frag-memory", 16, "Megabytes of IP fragments to buffer for reassembly")
+	flag.StringVar(&config.Decapsulate, "decap", "gre,vxlan,geneve,mpls,gtpu", "Comma separated tunnels to decapsulate, or none; only VXLAN and GENEVE IDs keep overlapping inner flows apart")
+	flag.Float64Var(&config.ReplaySpeed, "replay-speed", 0, "Pace offline packets at N times their original speed (0 for as fast as possible)")
+	flag.BoolVar(&config.PacketClock, "packet-clock", false, "Rotate output files by packet time instead of wall time")
+	flag.BoolVar(&config.AFPacket, "afpacket", false, "Capture from --device with AF_PACKET TPACKET_V3 rings instead of libpcap (Linux only)")
+	flag.UintVar(&config.AFPacketBlockSize, "afpacket-block-size", 512, "Kilobytes in each block of an AF_PACKET ring, a multiple of the page size")
+	flag.UintVar(&config.AFPacketBlocks, "afpacket-blocks", 128, "Number of blocks in each AF_PACKET ring")
+	flag.UintVar(&config.AFPacketFanout, "afpacket-fanout", 1, "Number of AF_PACKET sockets per device, which share its packets by flow")
 	flag.BoolVar(&config.Debug.DropOutput, "debug-drop-output", false, "Drop all output")
 	flag.BoolVar(&config.Debug.PrintBanners, "debug-print-banners", false, "Print Banners in short form")
 	flag.BoolVar(&config.Debug.PrintErrors, "debug-print-errors", false, "Print errors")
@@ -75,9 +115,11 @@ func main() {
 	flag.BoolVar(&config.Debug.PrintPackets, "debug-print-packets", false, "Print packets in short form")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] INPUT\n\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "INPUT: Packet source either as a PCAP file or a network device.\n")
-		fmt.Fprintf(os.Stderr, "       If the latter, use the `--device` switch.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTIONS] INPUT...\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "INPUT: Packet source either as PCAP or PCAPNG files, directories, and globs,\n")
+		fmt.Fprintf(os.Stderr, "       which are read in the order of their first packets, network devices,\n")
+		fmt.Fprintf(os.Stderr, "       which are merged by timestamp, or a directory to watch.  If one of the\n")
+		fmt.Fprintf(os.Stderr, "       latter, use the `--device` or `--watch` switch.\n\n")
 		fmt.Fprintf(os.Stderr, "OPTIONS:\n")
 		flag.PrintDefaults()
 	}
@@ -96,20 +138,43 @@ func main() {
 		os.Exit(1)
 	}
 
+	if config.OutputWindow > 0 && 24*60%config.OutputWindow != 0 {
+		fmt.Println("The output window must divide a day evenly, e.g. 5, 10, 15, 30, or 60 minutes.")
+		os.Exit(1)
+	}
+
+	if config.CommunityIDSeed > math.MaxUint16 {
+		fmt.Println("The Community ID seed must be between 0 and 65535.")
+		os.Exit(1)
+	}
+
+	timeoutPolicies, err = LoadTimeoutPolicies(config.TimeoutPolicyFile,
+		time.Duration(config.IdleTimeout)*time.Second, time.Duration(config.ActiveTimeout)*time.Second)
+	if err != nil {
+		log.Fatalln("Timeout policy error:", err)
+	}
+
 	if *isDevice {
-		packetHandle, err = pcap.OpenLive(args[0], int32(config.SnapLen), true,
-			time.Duration(config.PcapTimeout))
+		var devices *Devices
+		devices, err = OpenDevices(args)
+		packetSource = devices
+	} else if *watch {
+		var watcher *Watcher
+		watcher, err = NewWatcher(args[0], *watchCheckpoint, *watchAfter)
+		packetSource = watcher
 	} else {
-		packetHandle, err = pcap.OpenOffline(args[0])
+		var paths []string
+		if paths, err = ExpandInputs(args); err == nil {
+			packetSource, err = OpenFiles(paths)
+		}
 	}
-	defer packetHandle.Close()
-
 	if err != nil {
 		log.Fatalln("PCAP handle error:", err)
 	}
+	defer packetSource.Close()
 
 	if len(*bpf) > 0 {
-		if err := packetHandle.SetBPFFilter(*bpf); err != nil {
+		if err := packetSource.SetBPFFilter(*bpf); err != nil {
 			log.Fatalln("BPF error:", err)
 		}
 	}
@@ -117,9 +182,23 @@ func main() {
 	// Set up the workflow to collect flows and banners
 	done := make(chan struct{})
 	defer close(done)
+	// Live devices report their capture drops while running and at the end.
+	var capturing chan struct{}
+	var reported <-chan struct{}
+	if source, ok := packetSource.(statsSource); ok {
+		capturing = make(chan struct{})
+		reported = WriteCaptureStats(capturing, source)
+	}
 	wg.Add(5) // NOTE: number of computations that have goroutines; ensure they call wg.Done()
-	inPackets := GeneratePackets(done, packetHandle)
-	inFlows, inPayloads := AssignFlows(done, inPackets)
+	// Each AF_PACKET fanout shard has its own decoder and flow worker.
+	sources := []PacketSource{packetSource}
+	if devices, ok := packetSource.(*Devices); ok {
+		if shards := devices.Shards(); shards != nil {
+			sources = shards
+		}
+	}
+	inPackets := GenerateShardPackets(done, sources)
+	inFlows, inPayloads := AssignShardFlows(done, inPackets)
 	inBanners := ExtractBanners(done, inPayloads)
 	if config.Debug.DropOutput {
 		DropFlows(done, inFlows)
@@ -131,5 +210,20 @@ func main() {
 	wg.Wait()
 	fmt.Printf("Processed %v packets (%v bytes) in %v flows with %v decoded, and %v truncated.\n",
 		stats.TotalPackets, stats.NumBytes, stats.TotalFlows, stats.NumDecoded, stats.NumTruncated)
+	if stats.NumEvicted > 0 {
+		fmt.Printf("Evicted %v flows because the flow cache was full.\n", stats.NumEvicted)
+	}
+	if stats.NumCollisions > 0 {
+		fmt.Printf("Resolved %v flow hash collisions.\n", stats.NumCollisions)
+	}
+	if stats.NumReassembled > 0 || stats.NumFragmentsDropped > 0 {
+		fmt.Printf("Reassembled %v fragmented packets, dropped %v incomplete ones, and saw %v overlapping fragments.\n",
+			stats.NumReassembled, stats.NumFragmentsDropped, stats.NumFragmentOverlaps)
+	}
+	printDecodeErrors()
+	if capturing != nil {
+		close(capturing)
+		<-reported
+	}
 	// done will be closed by the deferred call.
 }
@@ -6,34 +6,26 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
-// Layers we want to parse. This approach speeds up packet processing by reusing the same
-// layer memory repeatedly.  Make sure to set numLayers to the number of layers you expect
-// since the memory is preallocated based on how many layers are expected.
+// Make sure to set numLayers to the number of layers you expect since the memory is preallocated
+// based on how many layers are expected.
 const numLayers = 4
 
-var (
-	eth     layers.Ethernet             // gopacket layer 1
-	dot1q   layers.Dot1Q                // gopacket layer 1
-	ip4     layers.IPv4                 // gopacket layer 2
-	ip6     layers.IPv6                 // gopacket layer 2
-	ipv6ext layers.IPv6ExtensionSkipper // gopacket layer 2
-	icmp    layers.ICMPv4               // gopacket layer 2
-	icmp6   layers.ICMPv6               // gopacket layer 2
-	tcp     layers.TCP                  // gopacket layer 3
-	udp     layers.UDP                  // gopacket layer 3
-	dns     layers.DNS                  //gopacket layer 4
-	payload gopacket.Payload            // gopacket layer 4
-)
+// maxInnerPackets limits how many tunnels and reassembled fragments deep we decode a packet.
+const maxInnerPackets = 8
 
 // TCP flags as constants
 const (
@@ -76,9 +68,15 @@ type MetaPacket struct {
 	protocol      layers.IPProtocol // TCP, UDP, ICMP, ICMPv6
 	payloadLength uint16            // Number of bytes in application payload
 	packetLength  uint16            // Number of bytes in the packet (CaptureInfo.Length)
+	fragments     uint16            // Number of IP fragments if the packet was reassembled
+	overlaps      uint16            // Number of fragments that overlapped earlier ones
+	tunnel        Tunnel            // Innermost tunnel of a decapsulated packet
+	iface         Interface         // Capture interface of a pcapng file or live device
 	tcpFlags      byte              // TCP flags if packet is TCP
 	tcpSeq        uint32            // TCP sequence number if packet is TCP
+	tcpAck        uint32            // TCP acknowledgment number if packet is TCP
 	vlanid        uint16            // VLAN ID for 802.1q (assume zero means no VLAN)
+	outerVlanid   uint16            // Outer VLAN ID for 802.1ad (QinQ) or zero
 	payload       [192]byte         // First 192 bytes of payload for banner extraction
 }
 
@@ -109,11 +107,44 @@ func printMetaPacket(mp MetaPacket) {
 
 // Summary statistics variables
 var stats struct {
-	NumBytes     uint64
-	NumDecoded   uint64
-	NumTruncated uint64
-	TotalPackets uint64
-	TotalFlows   uint64
+	NumBytes            uint64
+	NumDecoded          uint64
+	NumTruncated        uint64
+	TotalPackets        uint64
+	TotalFlows          uint64
+	NumCollisions       uint64            // Flow hash collisions resolved by the flow cache
+	NumEvicted          uint64            // Flows evicted because the flow cache was full
+	DecodeErrors        map[string]uint64 // Undecodable packets by type of error
+	NumReassembled      uint64            // Packets reassembled from IP fragments
+	NumFragmentsDropped uint64            // Incomplete fragmented packets dropped
+	NumFragmentOverlaps uint64            // IP fragments that overlapped earlier fragments
+}
+
+// statsMu guards stats.DecodeErrors, which the packet generators of several shards add to.
+var statsMu sync.Mutex
+
+// errFragment is the parser's error for an IP fragment, which we reassemble before decoding the
+// layers above IP.
+var errFragment = gopacket.UnsupportedLayerType(gopacket.LayerTypeFragment)
+
+// printDecodeErrors prints the number of undecodable packets by type of error.
+func printDecodeErrors() {
+	if len(stats.DecodeErrors) == 0 {
+		return
+	}
+	var (
+		errorTypes []string
+		total      uint64
+	)
+	for errorType, n := range stats.DecodeErrors {
+		errorTypes = append(errorTypes, errorType)
+		total += n
+	}
+	sort.Strings(errorTypes)
+	fmt.Printf("Could not decode %v packets:\n", total)
+	for _, errorType := range errorTypes {
+		fmt.Printf("  %s: %v\n", errorType, stats.DecodeErrors[errorType])
+	}
 }
 
 // FilterTCPFlags returns true one of the following TCP flag combinations exists.
@@ -133,153 +164,395 @@ func FilterTCPFlags(tcp layers.TCP) bool {
 	}
 }
 
+// tcpLayer decodes TCP like layers.TCP, but leaves the payload of port 53 as a payload: DNS
+// over TCP prefixes each message with its length, which layers.DNS doesn't expect, and a message
+// may span segments.
+type tcpLayer struct {
+	layers.TCP
+}
+
+// NextLayerType returns the layer type of the segment's port, or Payload instead of DNS.
+func (t *tcpLayer) NextLayerType() gopacket.LayerType {
+	if next := t.TCP.NextLayerType(); next != layers.LayerTypeDNS {
+		return next
+	}
+	return gopacket.LayerTypePayload
+}
+
+// decodeErrorType names the kind of error the parser hit for the summary statistics: either a layer
+// we don't decode or the layer that failed to decode after the layers in decoded.
+func decodeErrorType(err error, first gopacket.LayerType, decoded []gopacket.LayerType,
+	decoders map[gopacket.LayerType]gopacket.DecodingLayer) string {
+	if typ, ok := err.(gopacket.UnsupportedLayerType); ok {
+		return "unsupported " + gopacket.LayerType(typ).String()
+	}
+	typ := first
+	if len(decoded) > 0 {
+		if l, ok := decoders[decoded[len(decoded)-1]]; ok {
+			typ = l.NextLayerType()
+		}
+	}
+	return "malformed " + typ.String()
+}
+
 // GeneratePackets ...
-func GeneratePackets(done <-chan struct{}, handle *pcap.Handle) <-chan MetaPacket {
+func GeneratePackets(done <-chan struct{}, handle PacketSource) <-chan MetaPacket {
+	return GenerateShardPackets(done, []PacketSource{handle})[0]
+}
+
+// GenerateShardPackets decodes the packets of several sources, e.g. the shards of AF_PACKET
+// fanout, each in its own goroutine.  The sources share the summary statistics, the shutdown
+// signal, and the pcap file of undecodable packets.
+func GenerateShardPackets(done <-chan struct{}, handles []PacketSource) []<-chan MetaPacket {
 	// Set up a goroutine to handle shutdown signals. This allows the program to gracefully
 	// shut down on ^C or SIGTERM.
 	inSignal := make(chan os.Signal, 1)
-	shutdown := make(chan bool, 1)
+	shutdown := make(chan bool)
 	signal.Notify(inSignal, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-inSignal
 		fmt.Println("\nReceived ^C. Gracefully shutting down.")
-		shutdown <- true
+		close(shutdown)
 	}()
 
-	out := make(chan MetaPacket, 256)
+	// Undecodable packets are counted by type of error and optionally written to a pcap file
+	// for forensics.
+	stats.DecodeErrors = make(map[string]uint64)
+	stats.NumReassembled, stats.NumFragmentsDropped, stats.NumFragmentOverlaps = 0, 0, 0
+	var errorPcap *PcapWriter
+	if config.ErrorPcap {
+		errorPcap = NewPcapWriter(
+			filepath.Join(config.OutputPrefix, "undecodable"+config.OutputSlug+".pcap"),
+			handles[0].LinkType(), uint32(config.SnapLen),
+			time.Duration(config.OutputRotationInterval)*time.Minute)
+	}
+
+	var generators sync.WaitGroup
+	outs := make([]<-chan MetaPacket, len(handles))
+	for i, handle := range handles {
+		out := make(chan MetaPacket, 256)
+		outs[i] = out
+		generators.Add(1)
+		go func(handle PacketSource) {
+			generatePackets(done, handle, out, shutdown, errorPcap)
+			close(out)
+			generators.Done()
+		}(handle)
+	}
 	go func() {
-		defer close(out)
-		var mp MetaPacket
-		decoded := make([]gopacket.LayerType, 0, numLayers)
-		parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &dot1q, &ip4,
-			&ip6, &ipv6ext, &tcp, &udp, &icmp, &icmp6, &dns, &payload)
+		generators.Wait()
+		if errorPcap != nil {
+			errorPcap.Close()
+		}
+		wg.Done()
+	}()
+	return outs
+}
+
+// generatePackets decodes the packets of a source and sends them to out until the source runs
+// out or shutdown is signaled.
+func generatePackets(done <-chan struct{}, handle PacketSource, out chan<- MetaPacket,
+	shutdown <-chan bool, errorPcap *PcapWriter) {
+	// Layers we want to parse. This approach speeds up packet processing by reusing the same
+	// layer memory repeatedly.  Each goroutine has its own.
+	var (
+		eth     layers.Ethernet             // gopacket layer 1
+		sll     layers.LinuxSLL             // gopacket layer 1
+		sll2    linuxSLL2                   // gopacket layer 1
+		loop    layers.Loopback             // gopacket layer 1
+		raw     rawIP                       // gopacket layer 1
+		radio   layers.RadioTap             // gopacket layer 1
+		dot11   layers.Dot11                // gopacket layer 1
+		wifi    layers.Dot11Data            // gopacket layer 1
+		llc     layers.LLC                  // gopacket layer 1
+		snap    layers.SNAP                 // gopacket layer 1
+		dot1q   vlanTags                    // gopacket layer 1
+		ip4     layers.IPv4                 // gopacket layer 2
+		ip6     layers.IPv6                 // gopacket layer 2
+		ipv6ext layers.IPv6ExtensionSkipper // gopacket layer 2
+		ip6frag ipv6Fragment                // gopacket layer 2
+		gre     greTunnel                   // gopacket layer 2
+		erspan  layers.ERSPANII             // gopacket layer 2
+		vxlan   vxlanTunnel                 // gopacket layer 4
+		geneve  geneveTunnel                // gopacket layer 4
+		mpls    mplsTunnel                  // gopacket layer 2
+		gtp     gtpTunnel                   // gopacket layer 4
+		icmp    layers.ICMPv4               // gopacket layer 2
+		icmp6   layers.ICMPv6               // gopacket layer 2
+		tcp     tcpLayer                    // gopacket layer 3
+		udp     layers.UDP                  // gopacket layer 3
+		dns     layers.DNS                  //gopacket layer 4
+		payload gopacket.Payload            // gopacket layer 4
+	)
+	var mp MetaPacket
+	decoded := make([]gopacket.LayerType, 0, numLayers)
+	// The first layer depends on the link type, e.g. Linux cooked captures from tcpdump -i any.
+	// Each interface of a pcapng file has its own link type.
+	interfaces, _ := handle.(interfaceSource)
+	handleLinkType := handle.LinkType()
+	first, err := firstLayerType(handleLinkType)
+	if err != nil && interfaces == nil {
+		log.Panicln("error: ", err)
+	}
+	decodingLayers := []gopacket.DecodingLayer{&eth, &sll, &sll2, &loop, &raw, &radio, &dot11,
+		&wifi, &llc, &snap, &dot1q, &ip4, &ip6, &ipv6ext, &ip6frag,
+		&gre, &erspan, &vxlan, &geneve, &mpls, &gtp, &tcp, &udp, &icmp, &icmp6, &dns, &payload}
+
+	// Interfaces have their own link types, and fragmented packets are reassembled and
+	// tunneled packets are decapsulated before the inner packets are decoded, so we keep a
+	// parser for each first layer.
+	parsers := make(map[gopacket.LayerType]*gopacket.DecodingLayerParser)
+	parserFor := func(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+		parser, ok := parsers[first]
+		if !ok {
+			parser = gopacket.NewDecodingLayerParser(first, decodingLayers...)
+			parsers[first] = parser
+		}
+		return parser
+	}
+	tunnels, err := parseTunnels(config.Decapsulate)
+	if err != nil {
+		log.Panicln("error: ", err)
+	}
+	gre.decap, vxlan.decap, geneve.decap = tunnels["gre"], tunnels["vxlan"], tunnels["geneve"]
+	mpls.decap, gtp.decap = tunnels["mpls"], tunnels["gtpu"]
+	defrag := NewDefragmenter(time.Duration(config.FragmentTimeout)*time.Second,
+		int(config.FragmentMemory)*1024*1024)
+	innerDecoded := make([]gopacket.LayerType, 0, numLayers)
+
+	// Undecodable packets are counted here and added to the summary statistics at the end.
+	decodeErrors := make(map[string]uint64)
+	decoders := make(map[gopacket.LayerType]gopacket.DecodingLayer)
+	for _, l := range decodingLayers {
+		for _, typ := range l.CanDecode().LayerTypes() {
+			decoders[typ] = l
+		}
+	}
+	var pace *pacer
+	if config.ReplaySpeed > 0 {
+		pace = &pacer{speed: config.ReplaySpeed}
+	}
 
-	Loop:
-		for {
-			select {
-			case <-done:
-			case <-shutdown:
+Loop:
+	for {
+		select {
+		case <-done:
+		case <-shutdown:
+			break Loop
+		default:
+			data, ci, err := handle.ZeroCopyReadPacketData()
+			if err == io.EOF {
+				// All packets from a PCAP file have been read (not applicable to a live device).
 				break Loop
-			default:
-				data, ci, err := handle.ZeroCopyReadPacketData()
-				if err == io.EOF {
-					// All packets from a PCAP file have been read (not applicable to a live device).
-					break Loop
-				} else if err != nil {
-					// We have an error reading a packet. Skip it.
-					continue Loop
-				}
+			} else if err != nil {
+				// We have an error reading a packet. Skip it.
+				continue Loop
+			}
 
-				// We have a valid packet, so parse it based on our layer parser.
-				stats.TotalPackets++
-				if err = parser.DecodeLayers(data, &decoded); err != nil {
-					// This error means we have a packet that does not conform to the layers we
-					// expected to receive.  That could mean we have something interesting to
-					// investigate.
-					//
-					// TODO: We need to provide an analytic or forensics capability for this case.
-					// Bytes in `data` describe the packet and can be dumped to a file for further
-					// analysis.
-					if config.Debug.PrintErrors {
-						log.Println(err)
-					}
-					continue Loop
-				}
-				stats.NumDecoded++
-				stats.NumBytes += uint64(len(data))
+			// In replay mode, we hold on to the packet until it's due at the replay speed.
+			if pace != nil && !pace.wait(ci.Timestamp, shutdown) {
+				break Loop
+			}
+			setPacketClock(ci.Timestamp)
 
-				if parser.Truncated {
-					// We have a truncated packet. Skip it for now.
-					// NOTE: How should we handle truncated packets?
-					stats.NumTruncated++
-					//continue Loop
+			// We have a valid packet, so parse it based on our layer parser.
+			atomic.AddUint64(&stats.TotalPackets, 1)
+			mp.fragments, mp.overlaps = 0, 0
+			mp.tunnel = Tunnel{}
+			length := len(data)
+			start, inner := first, 0 // The first layer and its index in decoded of the last parse
+			linkType := handleLinkType
+			if interfaces != nil {
+				mp.iface, linkType = interfaces.Interface(ci.InterfaceIndex)
+				if start, err = firstLayerType(linkType); err != nil {
+					decodeErrors["unsupported "+linkType.String()]++
+					continue Loop
 				}
+			}
+			parser := parserFor(start)
+			err = parser.DecodeLayers(data, &decoded)
 
-				// We are ready to send a Packet to packetChan, but we need to copy values, not copy
-				// references to values. We deep copy the slices we are interested in preserving across
-				// the channel.
-				// IDEA: This may be a profiling and optimization target.
-				mp.id = stats.NumDecoded
-				mp.timestamp = ci.Timestamp
-				mp.packetLength = uint16(len(data))
-				for _, typ := range decoded {
-					switch typ {
-					case layers.LayerTypeDot1Q:
-						mp.vlanid = dot1q.VLANIdentifier
+			// The parser stops at fragments and tunnels.  We go on to decode the reassembled
+			// packet or the packet inside the tunnel from its first layer and add its layers
+			// to decoded, so the innermost layers come last.
+			for i := 0; i < maxInnerPackets && (err == errFragment || err == errTunnel); i++ {
+				var innerData []byte
+				if err == errFragment {
+					// We hold on to fragments until we have the whole packet, which then
+					// counts as one packet with the length of all of its fragments.
+					var dg *Datagram
+					switch decoded[len(decoded)-1] {
 					case layers.LayerTypeIPv4:
-						mp.sip.Address = ip4.SrcIP.String()
-						mp.sip.Version = 4
-						mp.dip.Address = ip4.DstIP.String()
-						mp.dip.Version = 4
-					case layers.LayerTypeIPv6:
-						mp.sip.Address = ip6.SrcIP.String()
-						mp.sip.Version = 6
-						mp.dip.Address = ip6.DstIP.String()
-						mp.dip.Version = 6
-					case layers.LayerTypeTCP:
-						mp.sport = uint16(tcp.SrcPort)
-						mp.dport = uint16(tcp.DstPort)
-						mp.protocol = layers.IPProtocolTCP
-						mp.tcpSeq = tcp.Seq
-						mp.tcpFlags = 0x00
-						if config.FilterTCPFlags && FilterTCPFlags(tcp) {
-							log.Println("Dropping packet with suspicious flags: ", tcp)
-							continue Loop
-						}
-						if tcp.FIN {
-							mp.tcpFlags |= FIN
-						}
-						if tcp.SYN {
-							mp.tcpFlags |= SYN
-						}
-						if tcp.RST {
-							mp.tcpFlags |= RST
-						}
-						if tcp.PSH {
-							mp.tcpFlags |= PSH
-						}
-						if tcp.ACK {
-							mp.tcpFlags |= ACK
-						}
-						if tcp.URG {
-							mp.tcpFlags |= URG
-						}
-					case layers.LayerTypeUDP:
-						mp.sport = uint16(udp.SrcPort)
-						mp.dport = uint16(udp.DstPort)
-						mp.protocol = layers.IPProtocolUDP
-					case layers.LayerTypeICMPv4:
-						mp.sport = uint16(icmp.TypeCode)
-						mp.dport = 0
-						mp.protocol = layers.IPProtocolICMPv4
-					case layers.LayerTypeICMPv6:
-						mp.sport = uint16(icmp6.TypeCode)
-						mp.dport = 0
-						mp.protocol = layers.IPProtocolICMPv6
-					case layers.LayerTypeDNS: // Treat this like a payload for now.
-						fallthrough
-					case gopacket.LayerTypePayload:
-						mp.payloadLength = uint16(len(payload))
-						if mp.protocol == layers.IPProtocolTCP && mp.payloadLength > 0 {
-							copy(mp.payload[:], zeroBytes192) // Delete older payloads
-							copy(mp.payload[:], payload.Payload())
+						dg = defrag.AddIPv4(&ip4, ci.Timestamp, len(data))
+					case layers.LayerTypeIPv6Fragment:
+						dg = defrag.AddIPv6(&ip6, &ip6frag, ci.Timestamp, len(data))
+					}
+					if dg == nil {
+						atomic.AddUint64(&stats.NumDecoded, 1)
+						atomic.AddUint64(&stats.NumBytes, uint64(len(data)))
+						continue Loop
+					}
+					start, innerData = dg.Protocol.LayerType(), dg.Payload
+					length = dg.Length
+					if length > math.MaxUint16 {
+						length = math.MaxUint16
+					}
+					mp.fragments = uint16(dg.NumFragments)
+					mp.overlaps = uint16(dg.Overlaps)
+				} else {
+					// The outer layers are about to be overwritten by the inner packet, so we
+					// keep the tunnel endpoints now.
+					t := decoders[decoded[len(decoded)-1]].(tunnelLayer)
+					mp.tunnel = Tunnel{}
+					mp.tunnel.Type, mp.tunnel.ID = t.tunnel()
+				Outer:
+					for j := len(decoded) - 1; j >= 0; j-- {
+						switch decoded[j] {
+						case layers.LayerTypeIPv4:
+							mp.tunnel.Sip = IPAddress{Version: 4, Address: ip4.SrcIP.String()}
+							mp.tunnel.Dip = IPAddress{Version: 4, Address: ip4.DstIP.String()}
+							break Outer
+						case layers.LayerTypeIPv6:
+							mp.tunnel.Sip = IPAddress{Version: 6, Address: ip6.SrcIP.String()}
+							mp.tunnel.Dip = IPAddress{Version: 6, Address: ip6.DstIP.String()}
+							break Outer
 						}
 					}
+					start, innerData = t.innerLayerType(), t.LayerPayload()
 				}
-				out <- mp
-				if config.Debug.PrintPackets {
-					printMetaPacket(mp)
+				inner = len(decoded)
+				err = parserFor(start).DecodeLayers(innerData, &innerDecoded)
+				decoded = append(decoded, innerDecoded...)
+			}
+			if err != nil {
+				// This error means we have a packet that does not conform to the layers we
+				// expected to receive.  That could mean we have something interesting to
+				// investigate, so we keep the packet as it was captured.
+				decodeErrors[decodeErrorType(err, start, decoded[inner:], decoders)]++
+				if config.Debug.PrintErrors {
+					log.Println(err)
+				}
+				if errorPcap != nil && linkType == handleLinkType { // One link type per pcap file
+					if err = errorPcap.WritePacket(ci, data); err != nil {
+						log.Println("Cannot write undecodable packet: ", err)
+					}
 				}
-				mp.sport = 0
-				mp.dport = 0
-				mp.protocol = 0
-				mp.payloadLength = 0
-				mp.tcpFlags = 0
-				mp.tcpSeq = 0
-				mp.vlanid = 0
+				continue Loop
 			}
+			id := atomic.AddUint64(&stats.NumDecoded, 1)
+			atomic.AddUint64(&stats.NumBytes, uint64(len(data)))
+
+			if parser.Truncated {
+				// We have a truncated packet. Skip it for now.
+				// NOTE: How should we handle truncated packets?
+				atomic.AddUint64(&stats.NumTruncated, 1)
+				//continue Loop
+			}
+
+			// We are ready to send a Packet to packetChan, but we need to copy values, not copy
+			// references to values. We deep copy the slices we are interested in preserving across
+			// the channel.
+			// IDEA: This may be a profiling and optimization target.
+			mp.id = id
+			mp.timestamp = ci.Timestamp
+			mp.packetLength = uint16(length)
+			for _, typ := range decoded {
+				switch typ {
+				case layers.LayerTypeDot1Q:
+					mp.vlanid = dot1q.inner
+					mp.outerVlanid = dot1q.outer
+				case layers.LayerTypeIPv4:
+					mp.sip.Address = ip4.SrcIP.String()
+					mp.sip.Version = 4
+					mp.dip.Address = ip4.DstIP.String()
+					mp.dip.Version = 4
+				case layers.LayerTypeIPv6:
+					mp.sip.Address = ip6.SrcIP.String()
+					mp.sip.Version = 6
+					mp.dip.Address = ip6.DstIP.String()
+					mp.dip.Version = 6
+				case layers.LayerTypeGRE: // Unless the inner packet has a transport layer
+					mp.sport = 0
+					mp.dport = 0
+					mp.protocol = layers.IPProtocolGRE
+				case layers.LayerTypeTCP:
+					mp.sport = uint16(tcp.SrcPort)
+					mp.dport = uint16(tcp.DstPort)
+					mp.protocol = layers.IPProtocolTCP
+					mp.tcpSeq = tcp.Seq
+					mp.tcpAck = tcp.Ack
+					mp.tcpFlags = 0x00
+					if config.FilterTCPFlags && FilterTCPFlags(tcp.TCP) {
+						log.Println("Dropping packet with suspicious flags: ", tcp)
+						continue Loop
+					}
+					if tcp.FIN {
+						mp.tcpFlags |= FIN
+					}
+					if tcp.SYN {
+						mp.tcpFlags |= SYN
+					}
+					if tcp.RST {
+						mp.tcpFlags |= RST
+					}
+					if tcp.PSH {
+						mp.tcpFlags |= PSH
+					}
+					if tcp.ACK {
+						mp.tcpFlags |= ACK
+					}
+					if tcp.URG {
+						mp.tcpFlags |= URG
+					}
+				case layers.LayerTypeUDP:
+					mp.sport = uint16(udp.SrcPort)
+					mp.dport = uint16(udp.DstPort)
+					mp.protocol = layers.IPProtocolUDP
+				case layers.LayerTypeICMPv4:
+					mp.sport = uint16(icmp.TypeCode)
+					mp.dport = 0
+					mp.protocol = layers.IPProtocolICMPv4
+				case layers.LayerTypeICMPv6:
+					mp.sport = uint16(icmp6.TypeCode)
+					mp.dport = 0
+					mp.protocol = layers.IPProtocolICMPv6
+				case layers.LayerTypeDNS, gopacket.LayerTypePayload:
+					// Treat DNS like a payload for now.  Each layer only holds the bytes of the
+					// packet that decoded it, so we take those of the last layer.
+					contents := payload.Payload()
+					if typ == layers.LayerTypeDNS {
+						contents = dns.Contents
+					}
+					mp.payloadLength = uint16(len(contents))
+					if mp.protocol == layers.IPProtocolTCP && mp.payloadLength > 0 {
+						copy(mp.payload[:], zeroBytes192) // Delete older payloads
+						copy(mp.payload[:], contents)
+					}
+				}
+			}
+			out <- mp
+			if config.Debug.PrintPackets {
+				printMetaPacket(mp)
+			}
+			mp.sport = 0
+			mp.dport = 0
+			mp.protocol = 0
+			mp.payloadLength = 0
+			mp.tcpFlags = 0
+			mp.tcpSeq = 0
+			mp.tcpAck = 0
+			mp.vlanid = 0
+			mp.outerVlanid = 0
 		}
-		wg.Done()
-	}()
-	return out
+	}
+	// Whatever is still incomplete at the end of the stream is dropped.
+	defrag.Flush()
+	atomic.AddUint64(&stats.NumReassembled, defrag.NumReassembled)
+	atomic.AddUint64(&stats.NumFragmentsDropped, defrag.NumDiscarded)
+	atomic.AddUint64(&stats.NumFragmentOverlaps, defrag.NumOverlaps)
+	statsMu.Lock()
+	for errorType, n := range decodeErrors {
+		stats.DecodeErrors[errorType] += n
+	}
+	statsMu.Unlock()
 }
@@ -5,6 +5,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/google/gopacket/pcap"
 )
@@ -174,30 +175,30 @@ func Example_packets_udpV4() {
 		stats.TotalPackets, stats.NumBytes, stats.TotalFlows, stats.NumDecoded, stats.NumTruncated)
 	os.RemoveAll(config.OutputPrefix)
 	// Output:
-	// 2009-04-07 09:57:26.36958  UDP 192.168.0.6:1393 -> 199.45.32.43:53, payload: 32
-	// 2009-04-07 09:57:26.38144  UDP 199.45.32.43:53 -> 192.168.0.6:1393, payload: 32
-	// 2009-04-07 09:57:26.38343  UDP 192.168.0.6:1394 -> 199.45.32.43:53, payload: 32
-	// 2009-04-07 09:57:26.39546  UDP 199.45.32.43:53 -> 192.168.0.6:1394, payload: 32
+	// 2009-04-07 09:57:26.36958  UDP 192.168.0.6:1393 -> 199.45.32.43:53, payload: 43
+	// 2009-04-07 09:57:26.38144  UDP 199.45.32.43:53 -> 192.168.0.6:1393, payload: 79
+	// 2009-04-07 09:57:26.38343  UDP 192.168.0.6:1394 -> 199.45.32.43:53, payload: 30
+	// 2009-04-07 09:57:26.39546  UDP 199.45.32.43:53 -> 192.168.0.6:1394, payload: 46
 	// 2009-04-27 16:29:55.99037  UDP 192.168.0.5:1026 -> 83.170.6.76:3544, payload: 77
 	// 2009-04-27 16:29:56.10216  UDP 83.170.6.76:3544 -> 192.168.0.5:1026, payload: 117
-	// 2009-04-27 16:33:37.88300  UDP 192.168.0.5:1465 -> 199.45.32.43:53, payload: 117
-	// 2009-04-27 16:33:37.89556  UDP 199.45.32.43:53 -> 192.168.0.5:1465, payload: 117
-	// 2009-04-27 16:37:26.03775  UDP 192.168.0.7:35393 -> 199.45.32.43:53, payload: 117
-	// 2009-04-27 16:37:26.05036  UDP 199.45.32.43:53 -> 192.168.0.7:35393, payload: 117
-	// 2009-04-27 16:37:50.77412  UDP 192.168.0.7:33912 -> 203.178.141.194:53, payload: 117
-	// 2009-04-27 16:37:50.97514  UDP 203.178.141.194:53 -> 192.168.0.7:33912, payload: 117
-	// 2009-04-27 16:39:56.52384  UDP 192.168.0.7:41008 -> 199.45.32.43:53, payload: 117
-	// 2009-04-27 16:39:56.92310  UDP 199.45.32.43:53 -> 192.168.0.7:41008, payload: 117
-	// 2009-04-27 16:40:53.51539  UDP 192.168.0.7:37308 -> 199.45.32.43:53, payload: 117
-	// 2009-04-27 16:40:53.52835  UDP 199.45.32.43:53 -> 192.168.0.7:37308, payload: 117
-	// 2009-04-27 16:47:08.64744  UDP 192.168.0.7:56309 -> 199.45.32.43:53, payload: 117
-	// 2009-04-27 16:47:08.65843  UDP 199.45.32.43:53 -> 192.168.0.7:56309, payload: 117
-	// 2009-04-27 16:47:17.52596  UDP 192.168.0.7:45558 -> 199.45.32.43:53, payload: 117
-	// 2009-04-27 16:47:17.53708  UDP 199.45.32.43:53 -> 192.168.0.7:45558, payload: 117
-	// 2009-04-29 13:42:33.45696  UDP 192.168.0.7:56305 -> 199.45.32.43:53, payload: 117
-	// 2009-04-29 13:42:33.47450  UDP 199.45.32.43:53 -> 192.168.0.7:56305, payload: 117
-	// 2009-04-29 13:44:36.04307  UDP 192.168.0.7:53983 -> 199.45.32.43:53, payload: 117
-	// 2009-04-29 13:44:36.05559  UDP 199.45.32.43:53 -> 192.168.0.7:53983, payload: 117
+	// 2009-04-27 16:33:37.88300  UDP 192.168.0.5:1465 -> 199.45.32.43:53, payload: 32
+	// 2009-04-27 16:33:37.89556  UDP 199.45.32.43:53 -> 192.168.0.5:1465, payload: 100
+	// 2009-04-27 16:37:26.03775  UDP 192.168.0.7:35393 -> 199.45.32.43:53, payload: 30
+	// 2009-04-27 16:37:26.05036  UDP 199.45.32.43:53 -> 192.168.0.7:35393, payload: 58
+	// 2009-04-27 16:37:50.77412  UDP 192.168.0.7:33912 -> 203.178.141.194:53, payload: 30
+	// 2009-04-27 16:37:50.97514  UDP 203.178.141.194:53 -> 192.168.0.7:33912, payload: 253
+	// 2009-04-27 16:39:56.52384  UDP 192.168.0.7:41008 -> 199.45.32.43:53, payload: 90
+	// 2009-04-27 16:39:56.92310  UDP 199.45.32.43:53 -> 192.168.0.7:41008, payload: 119
+	// 2009-04-27 16:40:53.51539  UDP 192.168.0.7:37308 -> 199.45.32.43:53, payload: 42
+	// 2009-04-27 16:40:53.52835  UDP 199.45.32.43:53 -> 192.168.0.7:37308, payload: 96
+	// 2009-04-27 16:47:08.64744  UDP 192.168.0.7:56309 -> 199.45.32.43:53, payload: 28
+	// 2009-04-27 16:47:08.65843  UDP 199.45.32.43:53 -> 192.168.0.7:56309, payload: 164
+	// 2009-04-27 16:47:17.52596  UDP 192.168.0.7:45558 -> 199.45.32.43:53, payload: 28
+	// 2009-04-27 16:47:17.53708  UDP 199.45.32.43:53 -> 192.168.0.7:45558, payload: 164
+	// 2009-04-29 13:42:33.45696  UDP 192.168.0.7:56305 -> 199.45.32.43:53, payload: 33
+	// 2009-04-29 13:42:33.47450  UDP 199.45.32.43:53 -> 192.168.0.7:56305, payload: 70
+	// 2009-04-29 13:44:36.04307  UDP 192.168.0.7:53983 -> 199.45.32.43:53, payload: 45
+	// 2009-04-29 13:44:36.05559  UDP 199.45.32.43:53 -> 192.168.0.7:53983, payload: 269
 	// Processed 24 packets (3051 bytes) in 24 flows with 24 decoded, and 0 truncated.
 }
 
@@ -235,22 +236,22 @@ func Example_packets_udpV6() {
 	// Output:
 	// 2009-04-27 21:57:03.47668  UDP fe80::5.1026 -> fe80::76.3544, payload: 77
 	// 2009-04-27 21:57:03.48219  UDP fe80::76.3544 -> fe80::5.1026, payload: 117
-	// 2009-04-27 21:57:03.64097  UDP fe80::7.35393 -> fe80::43.53, payload: 117
-	// 2009-04-27 21:57:03.64317  UDP fe80::43.53 -> fe80::7.35393, payload: 117
-	// 2009-04-27 21:57:03.65489  UDP fe80::7.41008 -> fe80::43.53, payload: 117
-	// 2009-04-27 21:57:03.67070  UDP fe80::7.56309 -> fe80::43.53, payload: 117
-	// 2009-04-27 21:57:03.67286  UDP fe80::43.53 -> fe80::7.56309, payload: 117
-	// 2009-04-27 21:57:04.15066  UDP fe80::7.45558 -> fe80::43.53, payload: 117
-	// 2009-04-27 21:57:04.15282  UDP fe80::43.53 -> fe80::7.45558, payload: 117
-	// 2009-04-27 21:57:04.22950  UDP fe80::7.33912 -> fe80::194.53, payload: 117
-	// 2009-04-27 21:57:04.23171  UDP fe80::194.53 -> fe80::7.33912, payload: 117
-	// 2009-04-27 21:57:04.37197  UDP fe80::5.1465 -> fe80::43.53, payload: 117
-	// 2009-04-27 21:57:04.37414  UDP fe80::43.53 -> fe80::5.1465, payload: 117
-	// 2009-04-27 21:57:04.38861  UDP fe80::7.37308 -> fe80::43.53, payload: 117
-	// 2009-04-29 13:46:45.56711  UDP fe80::7.53983 -> fe80::43.53, payload: 117
-	// 2009-04-29 13:46:45.56939  UDP fe80::43.53 -> fe80::7.53983, payload: 117
-	// 2009-04-29 13:46:45.59107  UDP fe80::7.56305 -> fe80::43.53, payload: 117
-	// 2009-04-29 13:46:45.59340  UDP fe80::43.53 -> fe80::7.56305, payload: 117
+	// 2009-04-27 21:57:03.64097  UDP fe80::7.35393 -> fe80::43.53, payload: 30
+	// 2009-04-27 21:57:03.64317  UDP fe80::43.53 -> fe80::7.35393, payload: 70
+	// 2009-04-27 21:57:03.65489  UDP fe80::7.41008 -> fe80::43.53, payload: 90
+	// 2009-04-27 21:57:03.67070  UDP fe80::7.56309 -> fe80::43.53, payload: 28
+	// 2009-04-27 21:57:03.67286  UDP fe80::43.53 -> fe80::7.56309, payload: 300
+	// 2009-04-27 21:57:04.15066  UDP fe80::7.45558 -> fe80::43.53, payload: 28
+	// 2009-04-27 21:57:04.15282  UDP fe80::43.53 -> fe80::7.45558, payload: 252
+	// 2009-04-27 21:57:04.22950  UDP fe80::7.33912 -> fe80::194.53, payload: 30
+	// 2009-04-27 21:57:04.23171  UDP fe80::194.53 -> fe80::7.33912, payload: 382
+	// 2009-04-27 21:57:04.37197  UDP fe80::5.1465 -> fe80::43.53, payload: 32
+	// 2009-04-27 21:57:04.37414  UDP fe80::43.53 -> fe80::5.1465, payload: 172
+	// 2009-04-27 21:57:04.38861  UDP fe80::7.37308 -> fe80::43.53, payload: 42
+	// 2009-04-29 13:46:45.56711  UDP fe80::7.53983 -> fe80::43.53, payload: 45
+	// 2009-04-29 13:46:45.56939  UDP fe80::43.53 -> fe80::7.53983, payload: 404
+	// 2009-04-29 13:46:45.59107  UDP fe80::7.56305 -> fe80::43.53, payload: 33
+	// 2009-04-29 13:46:45.59340  UDP fe80::43.53 -> fe80::7.56305, payload: 112
 	// Processed 20 packets (3360 bytes) in 18 flows with 18 decoded, and 0 truncated.
 }
 
@@ -527,3 +528,283 @@ func Example_packets_vlan() {
 	// 2012-07-18 15:10:35.85404  TCP 10.0.0.9:60335 -> 10.0.0.6:8080, payload: 0
 	// Processed 239 packets (144569 bytes) in 22 flows with 239 decoded, and 0 truncated.
 }
+
+func Example_packets_errorPcap() {
+	var handle *pcap.Handle
+	handle, _ = pcap.OpenOffline("testdata/udp-v6.pcap")
+	defer handle.Close()
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+	config.OutputPrefix = "/tmp/ing/errors/"
+	config.OutputRotationInterval = 5
+	config.OutputSlug = "-udp-v6"
+	config.ErrorPcap = true
+	defer func() { config.ErrorPcap = false }()
+
+	// State
+	stats.NumBytes = 0
+	stats.NumDecoded = 0
+	stats.NumTruncated = 0
+	stats.TotalPackets = 0
+	stats.TotalFlows = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for range inFlows {
+	}
+	wg.Wait()
+	fmt.Printf("Processed %v packets (%v bytes) in %v flows with %v decoded, and %v truncated.\n",
+		stats.TotalPackets, stats.NumBytes, stats.TotalFlows, stats.NumDecoded, stats.NumTruncated)
+	printDecodeErrors()
+
+	// Read the undecodable packets back from the rotated pcap file.
+	files, _ := filepath.Glob(config.OutputPrefix + "undecodable-udp-v6-*.pcap")
+	for _, file := range files {
+		errors, _ := pcap.OpenOffline(file)
+		for {
+			data, ci, err := errors.ReadPacketData()
+			if err != nil {
+				break
+			}
+			fmt.Printf("%s: %v bytes\n", ci.Timestamp.Format("2006-01-02 15:04:05.00000"), len(data))
+		}
+		errors.Close()
+	}
+	os.RemoveAll(config.OutputPrefix)
+	// Output:
+	// Processed 20 packets (3360 bytes) in 18 flows with 18 decoded, and 0 truncated.
+	// Could not decode 2 packets:
+	//   malformed DNS: 2
+	// 2009-04-27 21:57:03.65704: 252 bytes
+	// 2009-04-27 21:57:04.39075: 181 bytes
+}
+
+func Example_packets_fragments() {
+	var handle *pcap.Handle
+	handle, _ = pcap.OpenOffline("testdata/ip-fragments.pcap")
+	defer handle.Close()
+
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+	config.FragmentTimeout = 30
+	config.FragmentMemory = 16
+
+	// State
+	stats.NumBytes = 0
+	stats.NumDecoded = 0
+	stats.NumTruncated = 0
+	stats.TotalPackets = 0
+	stats.TotalFlows = 0
+
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for flow := range inFlows {
+		fmt.Printf("%s: %v packets, %v bytes, %v fragmented, %v fragments, %v overlaps\n",
+			flow.Key.String(), flow.NumPackets, flow.NumBytes, flow.Initiator.NumFragmented,
+			flow.Initiator.NumFragments, flow.Initiator.FragOverlaps)
+	}
+	wg.Wait()
+	fmt.Printf("Processed %v packets (%v bytes) in %v flows with %v decoded, and %v truncated.\n",
+		stats.TotalPackets, stats.NumBytes, stats.TotalFlows, stats.NumDecoded, stats.NumTruncated)
+	fmt.Printf("Reassembled %v fragmented packets, dropped %v incomplete ones, and saw %v overlapping fragments.\n",
+		stats.NumReassembled, stats.NumFragmentsDropped, stats.NumFragmentOverlaps)
+	// Output:
+	// UDP 10.0.0.2:53 -> 10.0.0.1:5353: 1 packets, 359 bytes, 1 fragmented, 3 fragments, 0 overlaps
+	// UDP 10.0.0.1:5353 -> 10.0.0.2:53: 1 packets, 71 bytes, 0 fragmented, 0 fragments, 0 overlaps
+	// UDP 2001:db8::1.4000 -> 2001:db8::2.4001: 1 packets, 232 bytes, 1 fragmented, 2 fragments, 0 overlaps
+	// UDP 10.0.0.3:7000 -> 10.0.0.2:7001: 1 packets, 158 bytes, 1 fragmented, 3 fragments, 1 overlaps
+	// Processed 10 packets (878 bytes) in 4 flows with 10 decoded, and 0 truncated.
+	// Reassembled 3 fragmented packets, dropped 1 incomplete ones, and saw 1 overlapping fragments.
+}
+
+func Example_packets_tunnels() {
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+	defer func() { config.Decapsulate = "" }()
+
+	for _, decap := range []string{"gre,vxlan,geneve,mpls,gtpu", "none"} {
+		fmt.Println("Decapsulate:", decap)
+		config.Decapsulate = decap
+		handle, _ := pcap.OpenOffline("testdata/tunnels.pcap")
+		done := make(chan struct{})
+		wg.Add(2)
+		inPackets := GeneratePackets(done, handle)
+		inFlows, _ := AssignFlows(done, inPackets)
+		for flow := range inFlows {
+			fmt.Printf("%s, tunnel %v: %+v\n", flow.Key.String(), flow.Key.TunnelID, flow.Tunnel)
+		}
+		wg.Wait()
+		close(done)
+		handle.Close()
+	}
+	// Output:
+	// Decapsulate: gre,vxlan,geneve,mpls,gtpu
+	// TCP 10.1.1.1:40000 -> 10.1.1.2:80, tunnel 0: {Type:GRE ID:42 Sip:{Version:4 Address:192.0.2.1} Dip:{Version:4 Address:192.0.2.2}}
+	// UDP 10.1.1.1:5000 -> 10.1.1.2:5001, tunnel 100: {Type:VXLAN ID:100 Sip:{Version:4 Address:192.0.2.1} Dip:{Version:4 Address:192.0.2.2}}
+	// UDP 10.1.1.1:5000 -> 10.1.1.2:5001, tunnel 101: {Type:VXLAN ID:101 Sip:{Version:4 Address:192.0.2.1} Dip:{Version:4 Address:192.0.2.2}}
+	// UDP 10.1.1.1:5000 -> 10.1.1.2:5001, tunnel 200: {Type:GENEVE ID:200 Sip:{Version:4 Address:192.0.2.1} Dip:{Version:4 Address:192.0.2.2}}
+	// TCP 10.1.1.1:40000 -> 10.1.1.2:80, tunnel 0: {Type:MPLS ID:300 Sip:{Version:0 Address:} Dip:{Version:0 Address:}}
+	//  ICMPv4 8:0 10.1.1.1 -> 10.1.1.2, tunnel 0: {Type:GTP-U ID:4660 Sip:{Version:4 Address:192.0.2.1} Dip:{Version:4 Address:192.0.2.2}}
+	// Decapsulate: none
+	// GRE 192.0.2.1 -> 192.0.2.2, tunnel 0: {Type: ID:0 Sip:{Version:0 Address:} Dip:{Version:0 Address:}}
+	// UDP 192.0.2.1:50000 -> 192.0.2.2:4789, tunnel 0: {Type: ID:0 Sip:{Version:0 Address:} Dip:{Version:0 Address:}}
+	// UDP 192.0.2.1:50001 -> 192.0.2.2:4789, tunnel 0: {Type: ID:0 Sip:{Version:0 Address:} Dip:{Version:0 Address:}}
+	// UDP 192.0.2.1:50002 -> 192.0.2.2:6081, tunnel 0: {Type: ID:0 Sip:{Version:0 Address:} Dip:{Version:0 Address:}}
+	// TCP 10.1.1.1:40000 -> 10.1.1.2:80, tunnel 0: {Type: ID:0 Sip:{Version:0 Address:} Dip:{Version:0 Address:}}
+	// UDP 192.0.2.1:2152 -> 192.0.2.2:2152, tunnel 0: {Type: ID:0 Sip:{Version:0 Address:} Dip:{Version:0 Address:}}
+}
+
+func Example_packets_tunnelKeys() {
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+	config.Decapsulate = "gre,vxlan,geneve,mpls,gtpu"
+	config.Biflow = true
+	defer func() { config.Decapsulate, config.Biflow = "", false }()
+
+	handle, _ := pcap.OpenOffline("testdata/tunnel-keys.pcap")
+	defer handle.Close()
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for flow := range inFlows {
+		fmt.Printf("%s, count %v, key %s %v: %+v\n", flow.Key.String(), flow.NumPackets,
+			flow.Key.TunnelType, flow.Key.TunnelID, flow.Tunnel)
+	}
+	wg.Wait()
+	// Output:
+	// TCP 10.1.1.1:40000 -> 10.1.1.2:80, count 3, key GTP-U 0: {Type:GTP-U ID:4369 Sip:{Version:4 Address:192.0.2.1} Dip:{Version:4 Address:192.0.2.2}}
+	// UDP 10.1.1.1:5000 -> 10.1.1.2:5001, count 1, key GRE 0: {Type:GRE ID:42 Sip:{Version:4 Address:192.0.2.1} Dip:{Version:4 Address:192.0.2.2}}
+	// UDP 10.1.1.1:5000 -> 10.1.1.2:5001, count 1, key VXLAN 42: {Type:VXLAN ID:42 Sip:{Version:4 Address:192.0.2.1} Dip:{Version:4 Address:192.0.2.2}}
+}
+
+func Example_packets_linkTypes() {
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+
+	for _, file := range []string{"linux-sll", "raw-ip", "loopback", "radiotap"} {
+		handle, _ := pcap.OpenOffline("testdata/" + file + ".pcap")
+		fmt.Println(file, handle.LinkType())
+		done := make(chan struct{})
+		wg.Add(2)
+		inPackets := GeneratePackets(done, handle)
+		inFlows, _ := AssignFlows(done, inPackets)
+		for flow := range inFlows {
+			fmt.Println(flow.Key.String())
+		}
+		wg.Wait()
+		close(done)
+		handle.Close()
+	}
+	// Output:
+	// linux-sll Linux SLL
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000
+	// UDP 2001:db8::1.1000 -> 2001:db8::2.2000
+	// raw-ip Raw
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000
+	// UDP 2001:db8::1.1000 -> 2001:db8::2.2000
+	// loopback Null
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000
+	// UDP 2001:db8::1.1000 -> 2001:db8::2.2000
+	// radiotap RadioTap
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000
+	// UDP 2001:db8::1.1000 -> 2001:db8::2.2000
+}
+
+func Example_packets_pcapng() {
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+
+	handle, _ := OpenOffline("testdata/multi-interface.pcapng")
+	defer handle.Close()
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for flow := range inFlows {
+		fmt.Printf("%s, %d packets: %+v\n", flow.Key.String(), flow.NumPackets, flow.Interface)
+	}
+	wg.Wait()
+	// Output:
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000, 2 packets: {ID:0 Name:eth0 Description:Uplink Comment:mirror port}
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000, 2 packets: {ID:1 Name:tun0 Description: Comment:}
+}
+
+func Example_packets_files() {
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+
+	paths, _ := ExpandInputs([]string{"testdata/rotated/*.pcap"})
+	handle, _ := OpenFiles(paths)
+	defer handle.Close()
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for flow := range inFlows {
+		fmt.Printf("%s, %d packets from %s to %s\n", flow.Key.String(), flow.NumPackets,
+			flow.StartTime.UTC().Format("15:04:05"), flow.EndTime.UTC().Format("15:04:05"))
+	}
+	wg.Wait()
+	// Output:
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000, 6 packets from 00:00:00 to 00:01:20
+}
+
+func Example_packets_devices() {
+	// CL options
+	config.Debug.PrintPackets = false
+	config.Debug.PrintFlows = false
+	config.ActiveTimeout = 1800
+	config.IdleTimeout = 300
+
+	// Files stand in for the live devices.
+	var sources []PacketSource
+	for _, name := range []string{"capture-a", "capture-b"} {
+		source, _ := OpenOffline("testdata/rotated/" + name + ".pcap")
+		sources = append(sources, source)
+	}
+	handle := NewDevices([]string{"tap0", "tap1"}, sources)
+	defer handle.Close()
+	done := make(chan struct{})
+	defer close(done)
+	wg.Add(2)
+	inPackets := GeneratePackets(done, handle)
+	inFlows, _ := AssignFlows(done, inPackets)
+	for flow := range inFlows {
+		fmt.Printf("%s, %d packets on %s\n", flow.Key.String(), flow.NumPackets, flow.Interface.Name)
+	}
+	wg.Wait()
+	// Output:
+	// UDP 10.0.0.1:1000 -> 10.0.0.2:2000, 6 packets on tap1
+}
@@ -0,0 +1,123 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// maxPcapSize is the size in bytes at which a PcapWriter rotates its file, the same as the
+// lumberjack limit on JSON output files.
+const maxPcapSize = 100 * 1024 * 1024
+
+// PcapWriter writes packets to a pcap file that rotates like the JSON output files: every
+// rotation interval by the output clock or when it reaches maxPcapSize.  Rotated files are
+// renamed with the UTC time of their rotation, e.g.
+// undecodable-ing-2019-03-01T10-00-00.000.pcap, and a sequence number if several rotate in the
+// same millisecond, e.g. undecodable-ing-2019-03-01T10-00-00.000-1.pcap.  The file is only
+// created once there is a packet to write.  Its methods may be called from several goroutines.
+type PcapWriter struct {
+	mu       sync.Mutex
+	filename string
+	linkType layers.LinkType
+	snapLen  uint32
+	interval time.Duration
+	file     *os.File
+	w        *pcapgo.Writer
+	size     int64
+	opened   time.Time
+}
+
+// NewPcapWriter returns a writer of packets with the given link type and snapshot length to
+// filename.  An interval of zero disables rotation on time.
+func NewPcapWriter(filename string, linkType layers.LinkType, snapLen uint32,
+	interval time.Duration) *PcapWriter {
+	return &PcapWriter{filename: filename, linkType: linkType, snapLen: snapLen, interval: interval}
+}
+
+// WritePacket writes a packet with its original capture information, rotating the file first if
+// it is due.
+func (pw *PcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.file != nil && (pw.size >= maxPcapSize ||
+		(pw.interval > 0 && outputClock().Sub(pw.opened) >= pw.interval)) {
+		if err := pw.rotate(); err != nil {
+			return err
+		}
+	}
+	if pw.file == nil {
+		if err := pw.open(); err != nil {
+			return err
+		}
+	}
+	if err := pw.w.WritePacket(ci, data); err != nil {
+		return err
+	}
+	pw.size += int64(16 + len(data)) // Record header and data
+	return nil
+}
+
+// Rotate closes the current file, if any, and renames it with the output clock's time.  The next
+// packet starts a new file.
+func (pw *PcapWriter) Rotate() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.rotate()
+}
+
+// rotate rotates the file while pw.mu is held.
+func (pw *PcapWriter) rotate() error {
+	if pw.file == nil {
+		return nil
+	}
+	if err := pw.file.Close(); err != nil {
+		return err
+	}
+	pw.file, pw.w = nil, nil
+	ext := filepath.Ext(pw.filename)
+	stamped := strings.TrimSuffix(pw.filename, ext) + "-" +
+		outputClock().UTC().Format("2006-01-02T15-04-05.000")
+	rotated := stamped + ext
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s-%d%s", stamped, i, ext)
+	}
+	return os.Rename(pw.filename, rotated)
+}
+
+// Close rotates the current file so that every file written carries a timestamp.
+func (pw *PcapWriter) Close() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.rotate()
+}
+
+// open creates the file and its directory and writes the pcap file header.
+func (pw *PcapWriter) open() error {
+	if err := os.MkdirAll(filepath.Dir(pw.filename), 0700); err != nil {
+		return err
+	}
+	file, err := os.Create(pw.filename)
+	if err != nil {
+		return err
+	}
+	w := pcapgo.NewWriter(file)
+	if err = w.WriteFileHeader(pw.snapLen, pw.linkType); err != nil {
+		file.Close()
+		return err
+	}
+	pw.file, pw.w, pw.size, pw.opened = file, w, 24, outputClock() // 24 byte file header
+	return nil
+}
@@ -0,0 +1,52 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Testing
+
+func TestPcapWriterRotateSameTime(t *testing.T) {
+	config.PacketClock = true
+	defer func() { config.PacketClock = false }()
+	defer atomic.StoreInt64(&packetClock, 0)
+	atomic.StoreInt64(&packetClock, 0)
+	setPacketClock(time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC))
+
+	dir := t.TempDir()
+	pw := NewPcapWriter(filepath.Join(dir, "undecodable.pcap"), layers.LinkTypeEthernet, 65536, 0)
+	data := make([]byte, 60)
+	for i := 0; i < 3; i++ {
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(1551434400, 0), CaptureLength: 60,
+			Length: 60}
+		if err := pw.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := pw.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := []string{"undecodable-2019-03-01T10-00-00.000-1.pcap",
+		"undecodable-2019-03-01T10-00-00.000-2.pcap", "undecodable-2019-03-01T10-00-00.000.pcap"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got files %v, want %v", names, want)
+	}
+}
@@ -0,0 +1,89 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+)
+
+// RTTStats summarizes round-trip time samples.
+type RTTStats struct {
+	Min     time.Duration
+	Avg     time.Duration
+	Max     time.Duration
+	Samples uint64
+}
+
+// add includes a round-trip time sample in the summary.
+func (s *RTTStats) add(rtt time.Duration) {
+	s.Samples++
+	if s.Samples == 1 || rtt < s.Min {
+		s.Min = rtt
+	}
+	if rtt > s.Max {
+		s.Max = rtt
+	}
+	s.Avg += (rtt - s.Avg) / time.Duration(s.Samples)
+}
+
+// FlowRTT holds passive round-trip time estimates of a TCP flow, measured from where we capture.
+// The client side is the round trip to the initiator and back, and the server side is the round
+// trip to the responder and back, so their sum is the end-to-end round-trip time.  The handshake
+// estimates come from the SYN, SYN-ACK, and ACK timestamps, and the Client and Server summaries
+// come from data segments and the acknowledgments that cover them.
+type FlowRTT struct {
+	HandshakeClient time.Duration // ACK time - SYN-ACK time
+	HandshakeServer time.Duration // SYN-ACK time - SYN time
+	Client          RTTStats
+	Server          RTTStats
+	synTime         int64 // Timestamp in Unix nanoseconds of the latest SYN from the initiator
+	synAckTime      int64 // Timestamp in Unix nanoseconds of the first SYN-ACK from the responder
+}
+
+// rttProbe times one data segment until it is acknowledged.
+type rttProbe struct {
+	end    uint32 // Sequence number following the segment
+	sent   int64  // Timestamp in Unix nanoseconds the segment was seen
+	active bool
+}
+
+// handshake updates the handshake estimates with a TCP packet.  initiator is true if the packet
+// was sent by the flow's initiator.
+func (r *FlowRTT) handshake(mp *MetaPacket, initiator bool) {
+	ts := mp.timestamp.UnixNano()
+	switch {
+	case initiator && mp.tcpFlags&(SYN|ACK) == SYN:
+		// A retransmitted SYN is most likely the one the responder answers.
+		r.synTime = ts
+	case !initiator && mp.tcpFlags&(SYN|ACK) == SYN|ACK:
+		if r.synAckTime == 0 {
+			r.synAckTime = ts
+			if r.synTime != 0 && ts > r.synTime {
+				r.HandshakeServer = time.Duration(ts - r.synTime)
+			}
+		}
+	case initiator && mp.tcpFlags&(SYN|ACK) == ACK:
+		if r.synAckTime != 0 && r.HandshakeClient == 0 && ts > r.synAckTime {
+			r.HandshakeClient = time.Duration(ts - r.synAckTime)
+		}
+	}
+}
+
+// start begins timing a new data segment ending at end unless one is already outstanding.
+func (p *rttProbe) start(end uint32, ts int64) {
+	if !p.active {
+		p.end, p.sent, p.active = end, ts, true
+	}
+}
+
+// ack returns the round-trip time of the outstanding segment if ack covers it.
+func (p *rttProbe) ack(ack uint32, ts int64) (time.Duration, bool) {
+	if !p.active || int32(ack-p.end) < 0 {
+		return 0, false
+	}
+	p.active = false
+	if ts <= p.sent {
+		return 0, false
+	}
+	return time.Duration(ts - p.sent), true
+}
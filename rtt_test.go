@@ -0,0 +1,76 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Testing
+
+func TestRTTStats(t *testing.T) {
+	var s RTTStats
+	for _, ms := range []time.Duration{30, 10, 20} {
+		s.add(ms * time.Millisecond)
+	}
+	if s.Min != 10*time.Millisecond || s.Avg != 20*time.Millisecond ||
+		s.Max != 30*time.Millisecond || s.Samples != 3 {
+		t.Errorf("got %+v, want min 10ms, avg 20ms, max 30ms, and 3 samples", s)
+	}
+}
+
+func TestFlowRTTHandshake(t *testing.T) {
+	start := time.Date(2009, 4, 27, 21, 0, 0, 0, time.UTC)
+	at := func(ms int, flags uint8) *MetaPacket {
+		return &MetaPacket{timestamp: start.Add(time.Duration(ms) * time.Millisecond), tcpFlags: flags}
+	}
+
+	var r FlowRTT
+	r.handshake(at(0, SYN), true)
+	r.handshake(at(1000, SYN), true) // Retransmitted SYN
+	r.handshake(at(1040, SYN|ACK), false)
+	r.handshake(at(1045, ACK), true)
+	r.handshake(at(1050, PSH|ACK), true)
+	if r.HandshakeServer != 40*time.Millisecond || r.HandshakeClient != 5*time.Millisecond {
+		t.Errorf("got server %v and client %v, want 40ms and 5ms", r.HandshakeServer,
+			r.HandshakeClient)
+	}
+}
+
+func TestFlowRTTSamples(t *testing.T) {
+	start := time.Date(2009, 4, 27, 21, 0, 0, 0, time.UTC)
+	data := func(ms int, seq uint32, length uint16) *MetaPacket {
+		return &MetaPacket{timestamp: start.Add(time.Duration(ms) * time.Millisecond),
+			tcpFlags: PSH | ACK, tcpSeq: seq, payloadLength: length}
+	}
+	ack := func(ms int, ack uint32) *MetaPacket {
+		return &MetaPacket{timestamp: start.Add(time.Duration(ms) * time.Millisecond),
+			tcpFlags: ACK, tcpAck: ack}
+	}
+
+	var (
+		e     FlowEndpoint
+		stats RTTStats
+	)
+	sample := func(mp *MetaPacket) {
+		if rtt, ok := e.updateAck(mp); ok {
+			stats.add(rtt)
+		}
+	}
+	e.updateSeq(&MetaPacket{timestamp: start, tcpFlags: SYN, tcpSeq: 99})
+	e.updateSeq(data(10, 100, 100))
+	e.updateSeq(data(11, 200, 100)) // Not timed, since a segment is outstanding
+	sample(ack(30, 200))            // 20ms
+	e.updateSeq(data(40, 300, 100))
+	e.updateSeq(data(300, 300, 100)) // Retransmission, so no sample (Karn's algorithm)
+	sample(ack(310, 400))
+	e.updateSeq(data(320, 400, 100))
+	sample(ack(330, 400)) // Doesn't cover the segment
+	sample(ack(360, 500)) // 40ms
+	e.updateSeq(data(370, 500, 100))
+	sample(ack(900, 700)) // Covers bytes we never saw, so no sample
+	if stats.Samples != 2 || stats.Min != 20*time.Millisecond || stats.Max != 40*time.Millisecond {
+		t.Errorf("got %+v, want 2 samples from 20ms to 40ms", stats)
+	}
+}
@@ -0,0 +1,367 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// PacketSource is where GeneratePackets reads packets from.  A pcap.Handle reads a live device or
+// a pcap file with libpcap, a PcapngFile reads a pcapng file in pure Go, and Devices merges the
+// packets of several live devices.
+type PacketSource interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+	SetBPFFilter(expr string) error
+	Close()
+}
+
+// errNoPacket is returned by a PacketSource that has no packet yet but may have more later.  Like
+// the read timeout of a live device, it gives GeneratePackets a chance to shut down.
+var errNoPacket = errors.New("no packet yet")
+
+// Interface describes the capture interface of a packet.  Pcap files have one interface with ID 0
+// and no name, and pcapng files name each of their interfaces.  Live devices have their names but
+// all have ID 0, so that the traffic of several devices, such as the tap ports of each direction
+// of a link, makes the same flows.
+type Interface struct {
+	ID          uint32
+	Name        string
+	Description string
+	Comment     string
+}
+
+// interfaceSource is a PacketSource with several capture interfaces, each with its own link type.
+// The InterfaceIndex of a packet's CaptureInfo is the ID of its interface.
+type interfaceSource interface {
+	PacketSource
+	Interface(id int) (Interface, layers.LinkType)
+}
+
+// pcapngMagic is the block type of the section header that starts every pcapng file.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// OpenOffline opens a pcap or pcapng file.  Pcap files are read with libpcap and pcapng files
+// with a PcapngFile, which keeps the interfaces of multi-interface captures apart.
+func OpenOffline(path string) (PacketSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(pcapngMagic))
+	if _, err = io.ReadFull(file, magic); err != nil || !bytes.Equal(magic, pcapngMagic) {
+		file.Close()
+		handle, err := pcap.OpenOffline(path)
+		if err != nil {
+			return nil, err
+		}
+		return handle, nil
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return NewPcapngFile(file)
+}
+
+// PcapngFile reads packets from a pcapng file.  Interfaces may have different link types, so
+// LinkType is only that of the first interface; the link type of each packet is that of its
+// interface.  Interface IDs restart with each section of the file.
+type PcapngFile struct {
+	file       *os.File
+	reader     *pcapgo.NgReader
+	interfaces []Interface
+	linkTypes  []layers.LinkType
+	linkType   layers.LinkType // Of the first interface
+	bpf        string
+	filters    map[layers.LinkType]*pcap.BPF
+	first      []byte // The first packet, which we read to learn the first link type
+	firstCI    gopacket.CaptureInfo
+	firstErr   error
+}
+
+// NewPcapngFile starts reading a pcapng file and takes ownership of it.
+func NewPcapngFile(file *os.File) (*PcapngFile, error) {
+	p := &PcapngFile{file: file}
+	options := pcapgo.NgReaderOptions{
+		WantMixedLinkType:  true,
+		SkipUnknownVersion: true,
+		SectionEndCallback: func([]pcapgo.NgInterface, pcapgo.NgSectionInfo) {
+			p.interfaces, p.linkTypes = p.interfaces[:0], p.linkTypes[:0]
+		},
+	}
+	reader, err := pcapgo.NewNgReader(file, options)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	p.reader = reader
+	p.first, p.firstCI, p.firstErr = reader.ReadPacketData()
+	if p.firstErr == nil {
+		_, p.linkType = p.Interface(p.firstCI.InterfaceIndex)
+	}
+	return p, nil
+}
+
+// ZeroCopyReadPacketData returns the next packet that passes the BPF filter, if any.  The data
+// is overwritten by the next call.
+func (p *PcapngFile) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		var (
+			data []byte
+			ci   gopacket.CaptureInfo
+			err  error
+		)
+		if p.first != nil || p.firstErr != nil {
+			data, ci, err = p.first, p.firstCI, p.firstErr
+			p.first, p.firstErr = nil, nil
+		} else {
+			data, ci, err = p.reader.ZeroCopyReadPacketData()
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF // A truncated file ends like a complete one.
+		}
+		if err != nil {
+			return nil, ci, err
+		}
+		// Like libpcap, we report capture times in local time.
+		ci.Timestamp = ci.Timestamp.Local()
+		if p.matches(ci, data) {
+			return data, ci, nil
+		}
+	}
+}
+
+// matches returns true if there is no BPF filter or the packet passes it.  Filters are compiled
+// for each link type as we see it.
+func (p *PcapngFile) matches(ci gopacket.CaptureInfo, data []byte) bool {
+	if p.bpf == "" {
+		return true
+	}
+	_, linkType := p.Interface(ci.InterfaceIndex)
+	filter, ok := p.filters[linkType]
+	if !ok {
+		var err error
+		if filter, err = pcap.NewBPF(linkType, config.SnapLen, p.bpf); err != nil {
+			filter = nil // Drop packets of link types the filter doesn't apply to.
+		}
+		p.filters[linkType] = filter
+	}
+	return filter != nil && filter.Matches(ci, data)
+}
+
+// LinkType returns the link type of the first interface.
+func (p *PcapngFile) LinkType() layers.LinkType {
+	return p.linkType
+}
+
+// Interface returns the description and link type of an interface of the current section.
+func (p *PcapngFile) Interface(id int) (Interface, layers.LinkType) {
+	if id < len(p.interfaces) {
+		return p.interfaces[id], p.linkTypes[id]
+	}
+	for i := len(p.interfaces); i < p.reader.NInterfaces(); i++ {
+		ng, _ := p.reader.Interface(i)
+		p.interfaces = append(p.interfaces, Interface{ID: uint32(i), Name: ng.Name,
+			Description: ng.Description, Comment: ng.Comment})
+		p.linkTypes = append(p.linkTypes, ng.LinkType)
+	}
+	if id < len(p.interfaces) {
+		return p.interfaces[id], p.linkTypes[id]
+	}
+	return Interface{ID: uint32(id)}, layers.LinkTypeNull
+}
+
+// SetBPFFilter filters the packets we read.  The filter is compiled with libpcap, which is only
+// needed if there is a filter.
+func (p *PcapngFile) SetBPFFilter(expr string) error {
+	if _, err := pcap.NewBPF(p.linkType, config.SnapLen, expr); err != nil {
+		return err
+	}
+	p.bpf = expr
+	p.filters = make(map[layers.LinkType]*pcap.BPF)
+	return nil
+}
+
+// Close closes the file.
+func (p *PcapngFile) Close() {
+	p.file.Close()
+}
+
+// ExpandInputs returns the capture files named by INPUT arguments, each of which is a file, a
+// directory, or a glob pattern.  Directories are not searched recursively, and their hidden files
+// are skipped.
+func ExpandInputs(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, err
+			}
+			var n int
+			for _, match := range matches {
+				if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+					paths = append(paths, match)
+					n++
+				}
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("no files match %s", arg)
+			}
+			continue
+		}
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				paths = append(paths, filepath.Join(arg, entry.Name()))
+			}
+		}
+	}
+	return paths, nil
+}
+
+// PcapFiles reads several pcap and pcapng files as one stream of packets, one file after another
+// in the order of their first packets, so that flows carry across files, e.g. rotated captures.
+// Interfaces with the same ID in different files are the same interface.
+type PcapFiles struct {
+	paths    []string // Files yet to be read
+	current  PacketSource
+	linkType layers.LinkType // Of the current file
+	first    layers.LinkType // Of the first file
+	bpf      string
+}
+
+// OpenFiles opens capture files to read in the order of their first packets.  A single file is
+// simply opened with OpenOffline.
+func OpenFiles(paths []string) (PacketSource, error) {
+	switch len(paths) {
+	case 0:
+		return nil, fmt.Errorf("no input files")
+	case 1:
+		return OpenOffline(paths[0])
+	}
+	paths, err := sortByFirstPacket(paths)
+	if err != nil {
+		return nil, err
+	}
+	p := &PcapFiles{paths: paths[1:]}
+	if p.current, err = OpenOffline(paths[0]); err != nil {
+		return nil, err
+	}
+	p.linkType = p.current.LinkType()
+	p.first = p.linkType
+	return p, nil
+}
+
+// sortByFirstPacket sorts files by the timestamp of their first packet.  Files without packets
+// come first, and files that start at the same time stay in order.
+func sortByFirstPacket(paths []string) ([]string, error) {
+	starts := make(map[string]time.Time)
+	for _, path := range paths {
+		source, err := OpenOffline(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		_, ci, err := source.ZeroCopyReadPacketData()
+		source.Close()
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		starts[path] = ci.Timestamp
+	}
+	sorted := append([]string(nil), paths...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return starts[sorted[i]].Before(starts[sorted[j]])
+	})
+	return sorted, nil
+}
+
+// ZeroCopyReadPacketData returns the next packet, moving on to the next file at the end of each
+// file.  A file that can no longer be opened is skipped.
+func (p *PcapFiles) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := p.current.ZeroCopyReadPacketData()
+		if err != io.EOF || len(p.paths) == 0 {
+			return data, ci, err
+		}
+		p.current.Close()
+		path := p.paths[0]
+		p.paths = p.paths[1:]
+		source, err := OpenOffline(path)
+		if err == nil && p.bpf != "" {
+			err = source.SetBPFFilter(p.bpf)
+		}
+		if err != nil {
+			log.Println("Skipping", path+":", err)
+			if source != nil {
+				source.Close()
+			}
+			source = emptySource{}
+		}
+		p.current = source
+		p.linkType = p.current.LinkType()
+	}
+}
+
+// LinkType returns the link type of the first file.
+func (p *PcapFiles) LinkType() layers.LinkType {
+	return p.first
+}
+
+// Interface returns an interface of the current file and its link type.
+func (p *PcapFiles) Interface(id int) (Interface, layers.LinkType) {
+	if interfaces, ok := p.current.(interfaceSource); ok {
+		return interfaces.Interface(id)
+	}
+	return Interface{ID: uint32(id)}, p.linkType
+}
+
+// SetBPFFilter filters the packets of the current file and every file after it.
+func (p *PcapFiles) SetBPFFilter(expr string) error {
+	if err := p.current.SetBPFFilter(expr); err != nil {
+		return err
+	}
+	p.bpf = expr
+	return nil
+}
+
+// Close closes the current file.
+func (p *PcapFiles) Close() {
+	p.current.Close()
+}
+
+// emptySource stands in for a file that cannot be read.
+type emptySource struct{}
+
+func (emptySource) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+func (emptySource) LinkType() layers.LinkType      { return layers.LinkTypeNull }
+func (emptySource) SetBPFFilter(expr string) error { return nil }
+func (emptySource) Close()                         {}
@@ -0,0 +1,119 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// Testing
+
+func TestOpenOffline(t *testing.T) {
+	source, err := OpenOffline("testdata/ftp-banner.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := source.(*pcap.Handle); !ok {
+		t.Errorf("pcap file opened as %T", source)
+	}
+	source.Close()
+
+	source, err = OpenOffline("testdata/multi-interface.pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	ng, ok := source.(*PcapngFile)
+	if !ok {
+		t.Fatalf("pcapng file opened as %T", source)
+	}
+	if ng.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("got link type %v, want Ethernet", ng.LinkType())
+	}
+	want := []struct {
+		iface    Interface
+		linkType layers.LinkType
+	}{
+		{Interface{ID: 0, Name: "eth0", Description: "Uplink", Comment: "mirror port"},
+			layers.LinkTypeEthernet},
+		{Interface{ID: 1, Name: "tun0"}, layers.LinkTypeRaw},
+	}
+	var n int
+	for {
+		_, ci, err := ng.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		w := want[n%2]
+		if iface, linkType := ng.Interface(ci.InterfaceIndex); iface != w.iface ||
+			linkType != w.linkType {
+			t.Errorf("packet %d: got %+v and %v, want %+v and %v", n, iface, linkType, w.iface,
+				w.linkType)
+		}
+		n++
+	}
+	if n != 4 {
+		t.Errorf("got %d packets, want 4", n)
+	}
+
+	if _, err = OpenOffline("testdata/missing.pcapng"); err == nil {
+		t.Error("opened a missing file")
+	}
+}
+
+func TestExpandInputs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"testdata/udp.pcap"}, []string{"testdata/udp.pcap"}},
+		{[]string{"testdata/rotated"},
+			[]string{"testdata/rotated/capture-a.pcap", "testdata/rotated/capture-b.pcap"}},
+		{[]string{"testdata/rotated/*-b.pcap", "testdata/udp.pcap"},
+			[]string{"testdata/rotated/capture-b.pcap", "testdata/udp.pcap"}},
+	}
+	for _, test := range tests {
+		got, err := ExpandInputs(test.args)
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ExpandInputs(%q) = %q, %v; want %q", test.args, got, err, test.want)
+		}
+	}
+	for _, args := range [][]string{{"testdata/missing.pcap"}, {"testdata/rotated/*.pcapng"}} {
+		if _, err := ExpandInputs(args); err == nil {
+			t.Errorf("ExpandInputs(%q) succeeded", args)
+		}
+	}
+}
+
+func TestOpenFiles(t *testing.T) {
+	source, err := OpenFiles([]string{"testdata/rotated/capture-a.pcap",
+		"testdata/rotated/capture-b.pcap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	var seconds []int64
+	for {
+		_, ci, err := source.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		seconds = append(seconds, ci.Timestamp.Unix()-1546300800)
+	}
+	if want := []int64{0, 10, 20, 60, 70, 80}; !reflect.DeepEqual(seconds, want) {
+		t.Errorf("got packets at %v seconds, want %v", seconds, want)
+	}
+
+	if _, err = OpenFiles(nil); err == nil {
+		t.Error("opened no files")
+	}
+}
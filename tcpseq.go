@@ -0,0 +1,162 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"time"
+)
+
+// tcpReorderWindow is how soon after a sequence gap opens that a segment filling it counts as
+// out of order rather than retransmitted.
+const tcpReorderWindow = 3 * time.Millisecond
+
+// maxTCPHoles bounds the number of open sequence gaps tracked per direction.  When a new gap
+// opens and all slots are in use, the oldest gap is forgotten and its bytes stay missing.
+const maxTCPHoles = 4
+
+// tcpHole is a range of sequence space [start, end) that a sender skipped over.
+type tcpHole struct {
+	start  uint32
+	end    uint32
+	opened int64 // Timestamp in Unix nanoseconds of the segment that opened the gap
+}
+
+// tcpSeqTracker follows the sequence space one side of a TCP connection has sent.  Sequence
+// numbers wrap, so they are always compared by their signed 32-bit difference.
+type tcpSeqTracker struct {
+	next     uint32 // Next expected sequence number
+	seen     bool   // Have we seen a segment yet?
+	holes    [maxTCPHoles]tcpHole
+	numHoles int
+	probe    rttProbe // Data segment timed for round-trip time samples
+}
+
+// updateSeq adds a TCP segment sent by the endpoint to its retransmission, out-of-order, and gap
+// counters.  New data segments are timed for round-trip time samples, and, following Karn's
+// algorithm, a retransmission discards the outstanding sample since its acknowledgment would be
+// ambiguous.
+func (e *FlowEndpoint) updateSeq(mp *MetaPacket) {
+	// The sequence number of a RST may be anything, so we skip it.  Pure ACKs and keep-alives
+	// don't use any sequence space, so they only give us the initial sequence number.
+	if mp.tcpFlags&RST == RST {
+		return
+	}
+	var (
+		t      = &e.seq
+		seq    = mp.tcpSeq
+		length = uint32(mp.payloadLength)
+	)
+	if mp.tcpFlags&SYN == SYN {
+		length++
+	}
+	if mp.tcpFlags&FIN == FIN {
+		length++
+	}
+	if !t.seen {
+		t.next, t.seen = seq+length, true
+		return
+	}
+	if length == 0 {
+		return
+	}
+
+	end := seq + length
+	switch d := int32(seq - t.next); {
+	case d == 0:
+		t.next = end
+		t.probe.start(end, mp.timestamp.UnixNano())
+	case d > 0:
+		// The sender skipped sequence space that we haven't seen (yet).
+		e.GapBytes += uint64(d)
+		t.openHole(t.next, seq, mp.timestamp.UnixNano())
+		t.next = end
+		t.probe.start(end, mp.timestamp.UnixNano())
+	default:
+		// The segment starts before the next expected byte, so it either fills a gap or resends
+		// bytes we've already seen.
+		fillEnd := end
+		if int32(end-t.next) > 0 {
+			fillEnd = t.next
+			t.next = end
+		}
+		filled, recent := t.fillHoles(seq, fillEnd, mp.timestamp.UnixNano())
+		e.GapBytes -= filled
+		t.probe.active = false
+		if filled > 0 && recent {
+			e.OutOfOrder++
+		} else {
+			e.Retransmissions++
+		}
+	}
+}
+
+// updateAck advances the endpoint's sequence space to an acknowledgment from its peer.  Bytes
+// that the peer acknowledged but we never saw were lost by the capture, so they count as missing
+// unless they show up shortly afterward.  If the acknowledgment covers the timed data segment, it
+// returns the round-trip time from us to the peer and back.
+func (e *FlowEndpoint) updateAck(mp *MetaPacket) (time.Duration, bool) {
+	t := &e.seq
+	if !t.seen || mp.tcpFlags&ACK == 0 {
+		return 0, false
+	}
+	if d := int32(mp.tcpAck - t.next); d > 0 {
+		e.GapBytes += uint64(d)
+		t.openHole(t.next, mp.tcpAck, mp.timestamp.UnixNano())
+		t.next = mp.tcpAck
+		// We missed part of the exchange, so the acknowledgment may be for a later segment.
+		t.probe.active = false
+	}
+	return t.probe.ack(mp.tcpAck, mp.timestamp.UnixNano())
+}
+
+// openHole records the gap [start, end).
+func (t *tcpSeqTracker) openHole(start, end uint32, ts int64) {
+	if t.numHoles == maxTCPHoles {
+		copy(t.holes[:], t.holes[1:])
+		t.numHoles--
+	}
+	t.holes[t.numHoles] = tcpHole{start, end, ts}
+	t.numHoles++
+}
+
+// fillHoles removes [start, end) from the open gaps.  It returns the number of missing bytes the
+// range filled and whether it filled a gap within tcpReorderWindow of it opening.
+func (t *tcpSeqTracker) fillHoles(start, end uint32, ts int64) (filled uint64, recent bool) {
+	for i := 0; i < t.numHoles; i++ {
+		h := &t.holes[i]
+		lo, hi := h.start, h.end
+		if int32(start-lo) > 0 {
+			lo = start
+		}
+		if int32(end-hi) < 0 {
+			hi = end
+		}
+		if int32(hi-lo) <= 0 {
+			continue
+		}
+		filled += uint64(hi - lo)
+		if time.Duration(ts-h.opened) < tcpReorderWindow {
+			recent = true
+		}
+		switch {
+		case lo == h.start && hi == h.end:
+			copy(t.holes[i:], t.holes[i+1:t.numHoles])
+			t.numHoles--
+			i--
+		case lo == h.start:
+			h.start = hi
+		case hi == h.end:
+			h.end = lo
+		case t.numHoles < maxTCPHoles:
+			// The range splits the gap in two.
+			t.holes[t.numHoles] = tcpHole{hi, h.end, h.opened}
+			t.numHoles++
+			h.end = lo
+		default:
+			// There's no room to split the gap, so we keep its first part and give up on the
+			// second, whose bytes stay missing.
+			h.end = lo
+		}
+	}
+	return
+}
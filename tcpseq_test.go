@@ -0,0 +1,60 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Testing
+
+func TestTCPSequenceTracking(t *testing.T) {
+	start := time.Date(2009, 4, 27, 21, 0, 0, 0, time.UTC)
+	// segment returns a data segment of length bytes at offset from an initial sequence number
+	// near the wrap, sent ms milliseconds after start.
+	segment := func(offset, length uint32, ms int) MetaPacket {
+		return MetaPacket{timestamp: start.Add(time.Duration(ms) * time.Millisecond),
+			tcpFlags: PSH | ACK, tcpSeq: 0xfffffff0 + offset, payloadLength: uint16(length)}
+	}
+	ack := func(offset uint32, ms int) MetaPacket {
+		return MetaPacket{timestamp: start.Add(time.Duration(ms) * time.Millisecond),
+			tcpFlags: ACK, tcpAck: 0xfffffff0 + offset}
+	}
+	syn := MetaPacket{timestamp: start, tcpFlags: SYN, tcpSeq: 0xffffffef}
+
+	tests := []struct {
+		name     string
+		packets  []MetaPacket
+		acks     []MetaPacket
+		retrans  uint64
+		ooo      uint64
+		gapBytes uint64
+	}{
+		{"in order", []MetaPacket{syn, segment(0, 100, 1), segment(100, 100, 2)}, nil, 0, 0, 0},
+		{"retransmission", []MetaPacket{syn, segment(0, 100, 1), segment(100, 100, 2),
+			segment(0, 100, 200)}, nil, 1, 0, 0},
+		{"reordered", []MetaPacket{syn, segment(100, 100, 1), segment(0, 100, 2)}, nil, 0, 1, 0},
+		{"late fill", []MetaPacket{syn, segment(100, 100, 1), segment(0, 100, 300)}, nil, 1, 0, 0},
+		{"gap", []MetaPacket{syn, segment(0, 100, 1), segment(150, 50, 2)}, nil, 0, 0, 50},
+		{"partial fill", []MetaPacket{syn, segment(0, 100, 1), segment(200, 100, 2),
+			segment(120, 40, 3)}, nil, 0, 1, 60},
+		{"acked unseen", []MetaPacket{syn, segment(0, 100, 1)}, []MetaPacket{ack(300, 2)}, 0, 0, 200},
+	}
+
+	for _, test := range tests {
+		var e FlowEndpoint
+		for i := range test.packets {
+			e.updateSeq(&test.packets[i])
+		}
+		for i := range test.acks {
+			e.updateAck(&test.acks[i])
+		}
+		if e.Retransmissions != test.retrans || e.OutOfOrder != test.ooo ||
+			e.GapBytes != test.gapBytes {
+			t.Errorf("%s: got (retransmissions: %v, out of order: %v, gap bytes: %v), "+
+				"want (%v, %v, %v)", test.name, e.Retransmissions, e.OutOfOrder, e.GapBytes,
+				test.retrans, test.ooo, test.gapBytes)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+// Connection states of a TCP flow, modeled on Zeek's conn_state.  Most of them need both
+// directions of a connection, i.e. --biflow; a unidirectional flow only ever shows the states its
+// own packets imply, such as S0, SH, RSTOS0, or OTH.
+const (
+	ConnStateS0     = "S0"     // Connection attempt seen, no reply
+	ConnStateS1     = "S1"     // Connection established, not terminated
+	ConnStateSF     = "SF"     // Normal establishment and termination
+	ConnStateREJ    = "REJ"    // Connection attempt rejected with a RST
+	ConnStateS2     = "S2"     // Connection established, close attempt by the initiator only
+	ConnStateS3     = "S3"     // Connection established, close attempt by the responder only
+	ConnStateRSTO   = "RSTO"   // Connection established, initiator aborted (sent a RST)
+	ConnStateRSTR   = "RSTR"   // Connection established, responder aborted (sent a RST)
+	ConnStateRSTOS0 = "RSTOS0" // Initiator sent a SYN followed by a RST, no SYN-ACK seen
+	ConnStateRSTRH  = "RSTRH"  // Responder sent a SYN-ACK followed by a RST, no SYN seen
+	ConnStateSH     = "SH"     // Initiator sent a SYN followed by a FIN, no SYN-ACK seen
+	ConnStateSHR    = "SHR"    // Responder sent a SYN-ACK followed by a FIN, no SYN seen
+	ConnStateOTH    = "OTH"    // No SYN seen, just midstream traffic
+)
+
+// Sides of a TCP connection for TCPConn.ClosedBy.
+const (
+	ClosedByInitiator = "initiator"
+	ClosedByResponder = "responder"
+)
+
+// Events seen from one side of a TCP connection.
+const (
+	tcpSawSYN    uint8 = 1 << iota // A SYN without an ACK
+	tcpSawSYNACK                   // A SYN with an ACK
+	tcpSawFIN
+	tcpSawRST
+)
+
+// TCPConn tracks the handshake and teardown of a TCP connection.  HandshakeComplete is set once
+// the initiator acknowledges the responder's SYN-ACK with the sequence number following its SYN,
+// and ClosedBy names the side that sent the first FIN or RST.
+type TCPConn struct {
+	State             string
+	HandshakeComplete bool
+	ClosedBy          string
+	initiator         uint8  // Events seen from the initiator
+	responder         uint8  // Events seen from the responder
+	rstBy             string // Side that sent the first RST
+	isn               uint32 // Initiator's initial sequence number
+}
+
+// update adds a TCP packet to the connection state.  initiator is true if the packet was sent by
+// the flow's initiator.
+func (c *TCPConn) update(flags uint8, seq uint32, initiator bool) {
+	var (
+		events *uint8
+		side   string
+	)
+	if initiator {
+		events, side = &c.initiator, ClosedByInitiator
+	} else {
+		events, side = &c.responder, ClosedByResponder
+	}
+
+	switch {
+	case flags&(SYN|ACK) == SYN:
+		*events |= tcpSawSYN
+		if initiator {
+			c.isn = seq
+		}
+	case flags&(SYN|ACK) == SYN|ACK:
+		*events |= tcpSawSYNACK
+	case flags&ACK == ACK && initiator && !c.HandshakeComplete:
+		c.HandshakeComplete = c.initiator&tcpSawSYN == tcpSawSYN &&
+			c.responder&tcpSawSYNACK == tcpSawSYNACK && seq == c.isn+1
+	}
+	if flags&(FIN|RST) != 0 && c.ClosedBy == "" {
+		c.ClosedBy = side
+	}
+	if flags&FIN == FIN {
+		*events |= tcpSawFIN
+	}
+	if flags&RST == RST {
+		*events |= tcpSawRST
+		if c.rstBy == "" {
+			c.rstBy = side
+		}
+	}
+	c.State = c.state()
+}
+
+// state returns the connection state implied by the events seen so far.
+func (c *TCPConn) state() string {
+	var (
+		syn    = c.initiator&tcpSawSYN == tcpSawSYN
+		synack = c.responder&tcpSawSYNACK == tcpSawSYNACK
+	)
+	switch {
+	case syn && !synack:
+		switch {
+		case c.responder&tcpSawRST == tcpSawRST:
+			return ConnStateREJ
+		case c.initiator&tcpSawRST == tcpSawRST:
+			return ConnStateRSTOS0
+		case c.initiator&tcpSawFIN == tcpSawFIN:
+			return ConnStateSH
+		}
+		return ConnStateS0
+	case !syn && synack:
+		switch {
+		case c.responder&tcpSawRST == tcpSawRST:
+			return ConnStateRSTRH
+		case c.responder&tcpSawFIN == tcpSawFIN:
+			return ConnStateSHR
+		}
+		return ConnStateOTH
+	case !syn && !synack:
+		return ConnStateOTH
+	}
+
+	// The connection was established.
+	switch {
+	case c.rstBy == ClosedByInitiator:
+		return ConnStateRSTO
+	case c.rstBy == ClosedByResponder:
+		return ConnStateRSTR
+	case c.initiator&c.responder&tcpSawFIN == tcpSawFIN:
+		return ConnStateSF
+	case c.initiator&tcpSawFIN == tcpSawFIN:
+		return ConnStateS2
+	case c.responder&tcpSawFIN == tcpSawFIN:
+		return ConnStateS3
+	}
+	return ConnStateS1
+}
@@ -0,0 +1,77 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+)
+
+// Testing
+
+// tcpSegment is a packet fed to TCPConn.update in tests.
+type tcpSegment struct {
+	flags     uint8
+	seq       uint32
+	initiator bool
+}
+
+func TestTCPConnStates(t *testing.T) {
+	const isn = 1000
+	var (
+		syn      = tcpSegment{SYN, isn, true}
+		synack   = tcpSegment{SYN | ACK, 5000, false}
+		ack      = tcpSegment{ACK, isn + 1, true}
+		data     = tcpSegment{PSH | ACK, isn + 1, true}
+		reply    = tcpSegment{PSH | ACK, 5001, false}
+		finInit  = tcpSegment{FIN | ACK, isn + 10, true}
+		finResp  = tcpSegment{FIN | ACK, 5010, false}
+		rstInit  = tcpSegment{RST, isn + 10, true}
+		rstResp  = tcpSegment{RST | ACK, 0, false}
+		badAck   = tcpSegment{ACK, isn + 7, true}
+		midInit  = tcpSegment{ACK, 42, true}
+		midResp  = tcpSegment{ACK, 43, false}
+		finOnly  = tcpSegment{FIN, isn + 1, true}
+		synFin   = tcpSegment{FIN | ACK, 5001, false}
+		synRst   = tcpSegment{RST, 5001, false}
+		synRetry = tcpSegment{SYN, isn, true}
+	)
+	tests := []struct {
+		name      string
+		segments  []tcpSegment
+		state     string
+		handshake bool
+		closedBy  string
+	}{
+		{"scan", []tcpSegment{syn, synRetry}, ConnStateS0, false, ""},
+		{"established", []tcpSegment{syn, synack, ack, data, reply}, ConnStateS1, true, ""},
+		{"complete", []tcpSegment{syn, synack, ack, data, reply, finInit, finResp}, ConnStateSF, true,
+			ClosedByInitiator},
+		{"rejected", []tcpSegment{syn, rstResp}, ConnStateREJ, false, ClosedByResponder},
+		{"initiator close", []tcpSegment{syn, synack, ack, finInit}, ConnStateS2, true,
+			ClosedByInitiator},
+		{"responder close", []tcpSegment{syn, synack, ack, finResp}, ConnStateS3, true,
+			ClosedByResponder},
+		{"initiator abort", []tcpSegment{syn, synack, ack, data, rstInit}, ConnStateRSTO, true,
+			ClosedByInitiator},
+		{"responder abort", []tcpSegment{syn, synack, ack, finInit, rstResp}, ConnStateRSTR, true,
+			ClosedByInitiator},
+		{"syn then rst", []tcpSegment{syn, rstInit}, ConnStateRSTOS0, false, ClosedByInitiator},
+		{"synack then rst", []tcpSegment{synack, synRst}, ConnStateRSTRH, false, ClosedByResponder},
+		{"syn then fin", []tcpSegment{syn, finOnly}, ConnStateSH, false, ClosedByInitiator},
+		{"synack then fin", []tcpSegment{synack, synFin}, ConnStateSHR, false, ClosedByResponder},
+		{"midstream", []tcpSegment{midInit, midResp, finInit}, ConnStateOTH, false, ClosedByInitiator},
+		{"bad handshake ack", []tcpSegment{syn, synack, badAck}, ConnStateS1, false, ""},
+	}
+
+	for _, test := range tests {
+		var c TCPConn
+		for _, s := range test.segments {
+			c.update(s.flags, s.seq, s.initiator)
+		}
+		if c.State != test.state || c.HandshakeComplete != test.handshake ||
+			c.ClosedBy != test.closedBy {
+			t.Errorf("%s: got (%s, %v, %q), want (%s, %v, %q)", test.name, c.State,
+				c.HandshakeComplete, c.ClosedBy, test.state, test.handshake, test.closedBy)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TCP states used to select a timeout policy.
+const (
+	TCPStateSYN         = "syn"         // Only SYNs without ACKs so far, e.g. a scan or half-open connection
+	TCPStateEstablished = "established" // ACKs seen but no FIN yet
+	TCPStateClosing     = "closing"     // At least one side sent a FIN
+)
+
+// TimeoutPolicy overrides the idle and active timeouts for flows that match its protocol and,
+// optionally, a port and a TCP state.  A zero port or an empty TCP state matches any flow, and a
+// zero timeout falls back to the next less specific policy and finally to the global timeout.
+// {"protocol": 17, "port": 53, "idle_timeout": 30, "active_timeout": 300}
+type TimeoutPolicy struct {
+	Protocol      layers.IPProtocol `json:"protocol"`
+	Port          uint16            `json:"port"`
+	TCPState      string            `json:"tcp_state"`
+	IdleTimeout   uint              `json:"idle_timeout"`
+	ActiveTimeout uint              `json:"active_timeout"`
+}
+
+// timeoutPolicyKey indexes a TimeoutPolicies table.
+type timeoutPolicyKey struct {
+	protocol layers.IPProtocol
+	port     uint16
+	tcpState string
+}
+
+// TimeoutPolicies is a table of timeout policies with the global timeouts as defaults.
+type TimeoutPolicies struct {
+	policies      map[timeoutPolicyKey]TimeoutPolicy
+	idleTimeout   time.Duration
+	activeTimeout time.Duration
+}
+
+// timeoutPolicies is the table of config.TimeoutPolicyFile, which main loads before the capture
+// starts so that a bad file is reported up front.  Without it, flows get the global timeouts.
+var timeoutPolicies *TimeoutPolicies
+
+// NewTimeoutPolicies returns a table of the given policies with global idle and active timeouts
+// as defaults.  A policy with an unknown TCP state is an error, since it would never match.
+func NewTimeoutPolicies(policies []TimeoutPolicy,
+	idle, active time.Duration) (*TimeoutPolicies, error) {
+	tp := &TimeoutPolicies{policies: make(map[timeoutPolicyKey]TimeoutPolicy, len(policies)),
+		idleTimeout: idle, activeTimeout: active}
+	for _, p := range policies {
+		switch p.TCPState {
+		case "", TCPStateSYN, TCPStateEstablished, TCPStateClosing:
+		default:
+			return nil, fmt.Errorf("unknown tcp_state %q in timeout policy for protocol %d, "+
+				"want %q, %q, or %q", p.TCPState, p.Protocol, TCPStateSYN, TCPStateEstablished,
+				TCPStateClosing)
+		}
+		tp.policies[timeoutPolicyKey{p.Protocol, p.Port, p.TCPState}] = p
+	}
+	return tp, nil
+}
+
+// LoadTimeoutPolicies reads a JSON array of TimeoutPolicy values from filename.  Unknown fields
+// are errors, so that a misspelled field isn't silently ignored.  An empty filename returns a
+// table with only the global timeouts.
+func LoadTimeoutPolicies(filename string, idle, active time.Duration) (*TimeoutPolicies, error) {
+	var policies []TimeoutPolicy
+	if filename != "" {
+		raw, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		if err = decoder.Decode(&policies); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	return NewTimeoutPolicies(policies, idle, active)
+}
+
+// Timeouts returns the idle and active timeouts for a flow.  Policies are matched from the most
+// to the least specific: protocol, port, and TCP state; protocol and port; protocol and TCP
+// state; and protocol alone.  The destination port of the flow key is tried before the source
+// port at each level with a port.
+func (tp *TimeoutPolicies) Timeouts(f *Flow) (idle time.Duration, active time.Duration) {
+	if len(tp.policies) == 0 {
+		return tp.idleTimeout, tp.activeTimeout
+	}
+	var (
+		proto = f.Key.Proto
+		state string
+		keys  [6]timeoutPolicyKey
+	)
+	if proto == layers.IPProtocolTCP {
+		state = tcpPolicyState(f)
+	}
+	keys[0] = timeoutPolicyKey{proto, f.Key.Dport, state}
+	keys[1] = timeoutPolicyKey{proto, f.Key.Sport, state}
+	keys[2] = timeoutPolicyKey{proto, f.Key.Dport, ""}
+	keys[3] = timeoutPolicyKey{proto, f.Key.Sport, ""}
+	keys[4] = timeoutPolicyKey{proto, 0, state}
+	keys[5] = timeoutPolicyKey{proto, 0, ""}
+	for i := range keys {
+		if p, ok := tp.policies[keys[i]]; ok {
+			if idle == 0 && p.IdleTimeout > 0 {
+				idle = time.Duration(p.IdleTimeout) * time.Second
+			}
+			if active == 0 && p.ActiveTimeout > 0 {
+				active = time.Duration(p.ActiveTimeout) * time.Second
+			}
+		}
+	}
+	if idle == 0 {
+		idle = tp.idleTimeout
+	}
+	if active == 0 {
+		active = tp.activeTimeout
+	}
+	return
+}
+
+// tcpPolicyState returns the TCP state of a flow for selecting a timeout policy.
+func tcpPolicyState(f *Flow) string {
+	flags := f.FirstTCPFlags | f.RestTCPFlags
+	switch {
+	case flags&FIN == FIN:
+		return TCPStateClosing
+	case flags&ACK == ACK:
+		return TCPStateEstablished
+	default:
+		return TCPStateSYN
+	}
+}
@@ -0,0 +1,66 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Testing
+
+func TestTimeoutPolicies(t *testing.T) {
+	policies, err := LoadTimeoutPolicies("etc/timeout-policy.json", 300*time.Second, 1800*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		flow   Flow
+		idle   time.Duration
+		active time.Duration
+	}{
+		{"dns query", Flow{Key: FlowKey{Proto: layers.IPProtocolUDP, Sport: 40000, Dport: 53}},
+			15 * time.Second, 120 * time.Second},
+		{"dns reply", Flow{Key: FlowKey{Proto: layers.IPProtocolUDP, Sport: 53, Dport: 40000}},
+			15 * time.Second, 120 * time.Second},
+		{"other udp", Flow{Key: FlowKey{Proto: layers.IPProtocolUDP, Sport: 40000, Dport: 5000}},
+			60 * time.Second, 1800 * time.Second},
+		{"ssh established", Flow{Key: FlowKey{Proto: layers.IPProtocolTCP, Sport: 40000, Dport: 22},
+			FirstTCPFlags: SYN, RestTCPFlags: ACK}, 3600 * time.Second, 86400 * time.Second},
+		{"ssh closing", Flow{Key: FlowKey{Proto: layers.IPProtocolTCP, Sport: 40000, Dport: 22},
+			FirstTCPFlags: SYN, RestTCPFlags: ACK | FIN}, 10 * time.Second, 86400 * time.Second},
+		{"tcp syn", Flow{Key: FlowKey{Proto: layers.IPProtocolTCP, Sport: 40000, Dport: 80},
+			FirstTCPFlags: SYN}, 30 * time.Second, 1800 * time.Second},
+		{"tcp established", Flow{Key: FlowKey{Proto: layers.IPProtocolTCP, Sport: 40000, Dport: 80},
+			FirstTCPFlags: SYN, RestTCPFlags: ACK}, 300 * time.Second, 1800 * time.Second},
+	}
+	for _, c := range cases {
+		idle, active := policies.Timeouts(&c.flow)
+		if idle != c.idle || active != c.active {
+			t.Errorf("%s: Timeouts() = %v, %v, want %v, %v", c.name, idle, active, c.idle, c.active)
+		}
+	}
+}
+
+func TestLoadTimeoutPoliciesErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, policy := range map[string]string{
+		"unknown state": `[{"protocol": 6, "tcp_state": "fin", "idle_timeout": 10}]`,
+		"state case":    `[{"protocol": 6, "tcp_state": "Closing", "idle_timeout": 10}]`,
+		"unknown field": `[{"protocol": 6, "idle_timout": 10}]`,
+		"not an array":  `{"protocol": 6, "idle_timeout": 10}`,
+	} {
+		filename := filepath.Join(dir, "policy.json")
+		if err := os.WriteFile(filename, []byte(policy), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadTimeoutPolicies(filename, time.Second, time.Second); err == nil {
+			t.Errorf("%s: loaded %s without error", name, policy)
+		}
+	}
+}
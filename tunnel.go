@@ -0,0 +1,221 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Tunnels we can decapsulate, as named with --decap.
+var tunnelNames = []string{"gre", "vxlan", "geneve", "mpls", "gtpu"}
+
+// layerTypeTunnel is the next layer type of a tunnel header we decapsulate.  The parser has no
+// decoder for it, so it stops at the tunnel and we can record the outer endpoints before the
+// inner packet is decoded into the same layers.  Layer types up to 1000 are reserved for gopacket.
+var layerTypeTunnel = gopacket.RegisterLayerType(1500,
+	gopacket.LayerTypeMetadata{Name: "Tunnel", Decoder: gopacket.DecodePayload})
+
+// errTunnel is the parser's error for a packet with a tunnel header we decapsulate.
+var errTunnel = gopacket.UnsupportedLayerType(layerTypeTunnel)
+
+// Tunnel describes the innermost tunnel that carried a flow.  Type is empty if the flow was not
+// tunneled.  ID is the GRE key, VXLAN or GENEVE network identifier (VNI), GTP-U tunnel endpoint
+// identifier (TEID), or bottom MPLS label.  MPLS has no outer endpoints.
+type Tunnel struct {
+	Type string
+	ID   uint32
+	Sip  IPAddress
+	Dip  IPAddress
+}
+
+// keyID returns the tunnel ID that is part of flow keys.  VXLAN and GENEVE VNIs name a virtual
+// network and are the same in both directions.  GTP-U TEIDs, GRE keys, and MPLS labels are
+// usually assigned by the receiving end, so each direction of a conversation has its own and
+// they are left out of flow keys; otherwise the directions would never make one biflow.  The
+// outer endpoints are left out too, so inner flows with overlapping addresses in different
+// GRE or GTP-U tunnels or MPLS VPNs share a key.
+func (t Tunnel) keyID() uint32 {
+	switch t.Type {
+	case "VXLAN", "GENEVE":
+		return t.ID
+	}
+	return 0
+}
+
+// tunnelLayer is a tunnel header decoder.  Its NextLayerType is layerTypeTunnel if we decapsulate
+// the tunnel, and the type of the inner packet is returned by innerLayerType.
+type tunnelLayer interface {
+	gopacket.DecodingLayer
+	tunnel() (string, uint32)
+	innerLayerType() gopacket.LayerType
+}
+
+// parseTunnels returns the set of tunnels named in a comma separated list, which may be "none".
+func parseTunnels(names string) (map[string]bool, error) {
+	tunnels := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || name == "none" {
+			continue
+		}
+		known := false
+		for _, tunnel := range tunnelNames {
+			known = known || name == tunnel
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown tunnel %q; use one of %s", name,
+				strings.Join(tunnelNames, ", "))
+		}
+		tunnels[name] = true
+	}
+	return tunnels, nil
+}
+
+// tunnelNext returns the next layer type after a tunnel header.  The parser stops at a tunnel we
+// decapsulate; the rest of any other tunnel is the payload of the outer flow.
+func tunnelNext(decap bool, inner gopacket.LayerType) gopacket.LayerType {
+	switch {
+	case !decap:
+		return gopacket.LayerTypePayload
+	case inner == gopacket.LayerTypeZero:
+		return inner
+	}
+	return layerTypeTunnel
+}
+
+// greTunnel decodes GRE, including ERSPAN mirrors.
+type greTunnel struct {
+	layers.GRE
+	decap bool
+}
+
+// NextLayerType returns layerTypeTunnel if we decapsulate GRE.
+func (t *greTunnel) NextLayerType() gopacket.LayerType {
+	return tunnelNext(t.decap, t.innerLayerType())
+}
+
+func (t *greTunnel) innerLayerType() gopacket.LayerType { return t.GRE.NextLayerType() }
+
+func (t *greTunnel) tunnel() (string, uint32) {
+	if !t.KeyPresent {
+		return "GRE", 0
+	}
+	return "GRE", t.Key
+}
+
+// vxlanTunnel decodes VXLAN.
+type vxlanTunnel struct {
+	layers.VXLAN
+	decap bool
+}
+
+// NextLayerType returns layerTypeTunnel if we decapsulate VXLAN.
+func (t *vxlanTunnel) NextLayerType() gopacket.LayerType {
+	return tunnelNext(t.decap, t.innerLayerType())
+}
+
+func (t *vxlanTunnel) innerLayerType() gopacket.LayerType { return t.VXLAN.NextLayerType() }
+
+func (t *vxlanTunnel) tunnel() (string, uint32) { return "VXLAN", t.VNI }
+
+// geneveTunnel decodes GENEVE.  gopacket's Geneve is not a DecodingLayer on its own.
+type geneveTunnel struct {
+	layers.Geneve
+	decap bool
+}
+
+// DecodeFromBytes decodes a GENEVE header, dropping the options of the previous one.
+func (t *geneveTunnel) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	t.Options = t.Options[:0]
+	return t.Geneve.DecodeFromBytes(data, df)
+}
+
+// CanDecode returns the GENEVE layer type.
+func (t *geneveTunnel) CanDecode() gopacket.LayerClass { return layers.LayerTypeGeneve }
+
+// NextLayerType returns layerTypeTunnel if we decapsulate GENEVE.
+func (t *geneveTunnel) NextLayerType() gopacket.LayerType {
+	return tunnelNext(t.decap, t.innerLayerType())
+}
+
+func (t *geneveTunnel) innerLayerType() gopacket.LayerType { return t.Geneve.NextLayerType() }
+
+func (t *geneveTunnel) tunnel() (string, uint32) { return "GENEVE", t.VNI }
+
+// gtpTunnel decodes GTP-U.
+type gtpTunnel struct {
+	layers.GTPv1U
+	decap bool
+}
+
+// DecodeFromBytes decodes a GTP-U header, dropping the extension headers of the previous one.
+func (t *gtpTunnel) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	t.GTPExtensionHeaders = t.GTPExtensionHeaders[:0]
+	return t.GTPv1U.DecodeFromBytes(data, df)
+}
+
+// NextLayerType returns layerTypeTunnel if we decapsulate GTP-U.
+func (t *gtpTunnel) NextLayerType() gopacket.LayerType {
+	return tunnelNext(t.decap, t.innerLayerType())
+}
+
+func (t *gtpTunnel) innerLayerType() gopacket.LayerType { return t.GTPv1U.NextLayerType() }
+
+func (t *gtpTunnel) tunnel() (string, uint32) { return "GTP-U", t.TEID }
+
+// mplsTunnel decodes an MPLS label stack.  MPLS doesn't say what it carries, so like gopacket we
+// guess IPv4 or IPv6 from the version of the payload.  MPLS has no outer endpoints, so when we
+// don't decapsulate it, we skip the labels and key flows on the inner packet alone.
+type mplsTunnel struct {
+	layers.BaseLayer
+	label uint32 // Bottom label, which identifies the VPN or service
+	decap bool
+}
+
+// DecodeFromBytes decodes the labels up to the bottom of the stack.
+func (t *mplsTunnel) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	for offset := 0; offset+4 <= len(data); offset += 4 {
+		entry := binary.BigEndian.Uint32(data[offset:])
+		if entry&0x100 == 0 { // Bottom of stack
+			continue
+		}
+		t.label = entry >> 12
+		t.BaseLayer = layers.BaseLayer{Contents: data[:offset+4], Payload: data[offset+4:]}
+		if t.innerLayerType() == gopacket.LayerTypeZero {
+			return fmt.Errorf("Unable to guess protocol of MPLS payload")
+		}
+		return nil
+	}
+	df.SetTruncated()
+	return fmt.Errorf("MPLS label stack without bottom of stack")
+}
+
+// CanDecode returns the MPLS layer types.
+func (t *mplsTunnel) CanDecode() gopacket.LayerClass { return layers.LayerTypeMPLS }
+
+// NextLayerType returns layerTypeTunnel if we decapsulate MPLS, and the inner packet otherwise.
+func (t *mplsTunnel) NextLayerType() gopacket.LayerType {
+	if !t.decap {
+		return t.innerLayerType()
+	}
+	return layerTypeTunnel
+}
+
+func (t *mplsTunnel) innerLayerType() gopacket.LayerType {
+	if len(t.Payload) > 0 {
+		switch t.Payload[0] >> 4 {
+		case 4:
+			return layers.LayerTypeIPv4
+		case 6:
+			return layers.LayerTypeIPv6
+		}
+	}
+	return gopacket.LayerTypeZero
+}
+
+func (t *mplsTunnel) tunnel() (string, uint32) { return "MPLS", t.label }
@@ -0,0 +1,39 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// Testing
+
+func TestParseTunnels(t *testing.T) {
+	tunnels, err := parseTunnels("gre, VXLAN,,gtpu")
+	if err != nil || len(tunnels) != 3 || !tunnels["gre"] || !tunnels["vxlan"] || !tunnels["gtpu"] {
+		t.Errorf("got %v, %v, want gre, vxlan, and gtpu", tunnels, err)
+	}
+	if tunnels, err = parseTunnels("none"); err != nil || len(tunnels) != 0 {
+		t.Errorf("none: got %v, %v, want no tunnels", tunnels, err)
+	}
+	if _, err = parseTunnels("gre,ipip"); err == nil {
+		t.Error("ipip: got no error for an unknown tunnel")
+	}
+}
+
+func TestMPLSTunnel(t *testing.T) {
+	var m mplsTunnel
+	// Labels 16 and 300, bottom of stack on the second, followed by an IPv4 header
+	data := []byte{0x00, 0x01, 0x00, 0x40, 0x00, 0x12, 0xc1, 0x40, 0x45, 0x00}
+	if err := m.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if typ, id := m.tunnel(); typ != "MPLS" || id != 300 || len(m.Payload) != 2 {
+		t.Errorf("got %s %d with %d payload bytes, want MPLS 300 with 2", typ, id, len(m.Payload))
+	}
+	if err := m.DecodeFromBytes(data[:4], gopacket.NilDecodeFeedback); err == nil {
+		t.Error("got no error for a label stack without bottom of stack")
+	}
+}
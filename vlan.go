@@ -0,0 +1,66 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Ethernet types of VLAN tags: 802.1Q, 802.1ad (QinQ), and the pre-standard QinQ type.
+const (
+	etherTypeDot1Q  = 0x8100
+	etherTypeDot1AD = 0x88a8
+	etherTypeQinQ   = 0x9100
+)
+
+// vlanTags decodes a stack of 802.1Q and 802.1ad VLAN tags as one layer.  Decoding each tag
+// with the same Dot1Q layer would keep only the last one, but provider networks put a service
+// tag (S-tag) outside the customer tag (C-tag), and customers' VLANs overlap.  inner is the
+// innermost tag, i.e. the only one for plain 802.1Q, and outer is the outermost tag if there is
+// more than one.  Tags in between are skipped.
+type vlanTags struct {
+	layers.BaseLayer
+	outer uint16
+	inner uint16
+	next  layers.EthernetType
+}
+
+// DecodeFromBytes decodes the tags up to the first Ethernet type that isn't a VLAN tag.
+func (v *vlanTags) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	var outermost uint16
+	for offset := 0; ; offset += 4 {
+		if len(data) < offset+4 {
+			df.SetTruncated()
+			return fmt.Errorf("VLAN tag length %d too short", len(data)-offset)
+		}
+		id := binary.BigEndian.Uint16(data[offset:]) & 0x0fff
+		if offset == 0 {
+			outermost = id
+		}
+		v.next = layers.EthernetType(binary.BigEndian.Uint16(data[offset+2:]))
+		switch v.next {
+		case etherTypeDot1Q, etherTypeDot1AD, etherTypeQinQ:
+			continue
+		}
+		v.inner, v.outer = id, 0
+		if offset > 0 {
+			v.outer = outermost
+		}
+		v.BaseLayer = layers.BaseLayer{Contents: data[:offset+4], Payload: data[offset+4:]}
+		return nil
+	}
+}
+
+// CanDecode returns the 802.1Q layer type, which gopacket also uses for 802.1ad.
+func (v *vlanTags) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeDot1Q
+}
+
+// NextLayerType returns the layer type after the innermost tag.
+func (v *vlanTags) NextLayerType() gopacket.LayerType {
+	return v.next.LayerType()
+}
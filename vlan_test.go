@@ -0,0 +1,47 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Testing
+
+func TestVLANTags(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []byte
+		outer, inner uint16
+		next         layers.EthernetType
+	}{
+		{"802.1Q", []byte{0x00, 0x64, 0x08, 0x00}, 0, 100, layers.EthernetTypeIPv4},
+		{"QinQ", []byte{0x00, 0x0a, 0x81, 0x00, 0x00, 0x64, 0x86, 0xdd}, 10, 100,
+			layers.EthernetTypeIPv6},
+		{"three tags", []byte{0x20, 0x1e, 0x81, 0x00, 0x01, 0x2c, 0x81, 0x00, 0x00, 0x64, 0x08,
+			0x00}, 30, 100, layers.EthernetTypeIPv4},
+	}
+
+	for _, test := range tests {
+		var v vlanTags
+		data := append(test.data, 0x45)
+		if err := v.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if v.outer != test.outer || v.inner != test.inner || v.next != test.next ||
+			len(v.Payload) != 1 {
+			t.Errorf("%s: got outer %d, inner %d, next %v, and %d payload bytes, want %d, %d, %v, and 1",
+				test.name, v.outer, v.inner, v.next, len(v.Payload), test.outer, test.inner, test.next)
+		}
+	}
+
+	var v vlanTags
+	truncated := []byte{0x00, 0x0a, 0x81, 0x00, 0x00}
+	if err := v.DecodeFromBytes(truncated, gopacket.NilDecodeFeedback); err == nil {
+		t.Error("truncated: got no error")
+	}
+}
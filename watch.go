@@ -0,0 +1,322 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// watchInterval is how often we look for new files in a watched directory.  A file is complete
+// once it is closed after writing or moved into the directory, which we learn from inotify on
+// Linux, or once it hasn't changed for watchSettle.  While reading a file, we save a checkpoint
+// every watchCheckpointInterval.
+const (
+	watchInterval           = time.Second
+	watchSettle             = time.Minute
+	watchCheckpointInterval = 10 * time.Second
+)
+
+// Watcher is a PacketSource that reads the capture files arriving in a spool directory, e.g.
+// from capture appliances that rotate their pcaps into it.  Complete files are read in the order
+// of their modification times as one stream of packets, so flows carry across files.  Progress is
+// saved to a checkpoint file after each file, every watchCheckpointInterval within a file, and
+// when the Watcher is closed, so that a restarted Watcher resumes where it left off.  After a
+// crash, that is the last checkpoint: the packets read since are read again, so their flows may
+// be written twice.  Processed files are kept, deleted, or moved to another directory.
+type Watcher struct {
+	dir        string
+	checkpoint string
+	after      string               // "keep", "delete", or a directory to move files to
+	processed  map[string]bool      // Files read to the end that are still in dir
+	seen       map[string]fileState // Unread files at the last scan
+	closed     <-chan string        // Files closed after writing or moved into dir, from inotify
+	unwatch    func()               // Stops inotify, which then closes closed
+	complete   map[string]bool      // Files inotify told us about that we haven't read yet
+	path       string               // Of the current file
+	current    PacketSource         // nil between files
+	packets    uint64               // Read from the current file
+	skip       uint64               // Packets of the current file read by the previous run
+	resume     watchProgress        // Where the previous run left off
+	saved      time.Time            // When we last saved a checkpoint
+	linkType   layers.LinkType      // Of the current file
+	first      layers.LinkType      // Of the first file, or Ethernet until it is opened
+	started    bool                 // Whether we have opened a file
+	bpf        string
+}
+
+// fileState is what we know about a file that may still be written.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// watchProgress is the contents of a checkpoint file: the files that have been read to the end,
+// and how many packets have been read from the current file, if any.
+type watchProgress struct {
+	Processed []string
+	Current   string
+	Packets   uint64
+}
+
+// NewWatcher starts watching a directory.  It doesn't wait for a complete file, which
+// ZeroCopyReadPacketData does.  The checkpoint file defaults to .ing-checkpoint in the directory.
+func NewWatcher(dir, checkpoint, after string) (*Watcher, error) {
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	if after != "keep" && after != "delete" {
+		if info, err := os.Stat(after); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("%s is not keep, delete, or a directory", after)
+		}
+	}
+	if checkpoint == "" {
+		checkpoint = filepath.Join(dir, ".ing-checkpoint")
+	}
+	w := &Watcher{dir: dir, checkpoint: checkpoint, after: after,
+		processed: make(map[string]bool), seen: make(map[string]fileState),
+		complete: make(map[string]bool), saved: time.Now(), first: layers.LinkTypeEthernet}
+	if raw, err := os.ReadFile(checkpoint); err == nil {
+		if err = json.Unmarshal(raw, &w.resume); err != nil {
+			return nil, fmt.Errorf("%s: %v", checkpoint, err)
+		}
+		for _, name := range w.resume.Processed {
+			w.processed[name] = true
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	var err error
+	if w.closed, w.unwatch, err = watchClosed(dir); err != nil {
+		log.Println("Cannot watch", dir+":", err)
+	}
+	log.Println("Waiting for capture files in", dir)
+	return w, nil
+}
+
+// ZeroCopyReadPacketData returns the next packet, moving on to the next complete file at the end
+// of each file.  It returns errNoPacket after waiting a while for a new file.
+func (w *Watcher) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		if w.current == nil && !w.openNext() {
+			w.wait()
+			return nil, gopacket.CaptureInfo{}, errNoPacket
+		}
+		data, ci, err := w.current.ZeroCopyReadPacketData()
+		if err == nil {
+			w.packets++
+			if w.skip > 0 {
+				w.skip--
+				continue
+			}
+			if time.Since(w.saved) >= watchCheckpointInterval {
+				w.save()
+			}
+		}
+		if err != io.EOF {
+			return data, ci, err
+		}
+		w.finish()
+	}
+}
+
+// wait waits for inotify to report a file or for watchInterval, whichever comes first.
+func (w *Watcher) wait() {
+	select {
+	case name, ok := <-w.closed:
+		if !ok {
+			w.closed = nil
+		} else {
+			w.complete[name] = true
+		}
+	case <-time.After(watchInterval):
+	}
+}
+
+// openNext opens the first complete file we haven't read, if any.  A file that cannot be opened
+// is skipped.
+func (w *Watcher) openNext() bool {
+	for _, name := range w.scan() {
+		path := filepath.Join(w.dir, name)
+		source, err := OpenOffline(path)
+		if err == nil && w.bpf != "" {
+			err = source.SetBPFFilter(w.bpf)
+		}
+		if err != nil {
+			log.Println("Skipping", path+":", err)
+			if source != nil {
+				source.Close()
+			}
+			w.processed[name] = true
+			continue
+		}
+		w.path, w.current, w.packets, w.skip = name, source, 0, 0
+		w.linkType = source.LinkType()
+		if !w.started {
+			w.first, w.started = w.linkType, true
+		}
+		if name == w.resume.Current {
+			// The previous run stopped in the middle of this file.
+			w.skip = w.resume.Packets
+			w.resume = watchProgress{}
+		}
+		return true
+	}
+	return false
+}
+
+// scan returns the complete files in the directory that we haven't read, in the order of their
+// modification times.  Hidden files, such as the default checkpoint file, are ignored.
+func (w *Watcher) scan() []string {
+	for more := w.closed != nil; more; {
+		select {
+		case name, ok := <-w.closed:
+			if !ok {
+				w.closed, more = nil, false
+			} else {
+				w.complete[name] = true
+			}
+		default:
+			more = false
+		}
+	}
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		log.Println("Cannot read", w.dir+":", err)
+		return nil
+	}
+	var names []string
+	modTimes := make(map[string]time.Time)
+	seen := make(map[string]fileState)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || w.processed[name] ||
+			filepath.Join(w.dir, name) == filepath.Clean(w.checkpoint) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		state := fileState{size: info.Size(), modTime: info.ModTime()}
+		settled := w.seen[name] == state && time.Since(state.modTime) >= watchSettle
+		seen[name] = state
+		if !w.complete[name] && !settled {
+			continue
+		}
+		names = append(names, name)
+		modTimes[name] = state.modTime
+	}
+	w.seen = seen
+	sort.Slice(names, func(i, j int) bool {
+		if !modTimes[names[i]].Equal(modTimes[names[j]]) {
+			return modTimes[names[i]].Before(modTimes[names[j]])
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+// finish closes the current file, saves a checkpoint, and deletes or moves the file if asked to.
+func (w *Watcher) finish() {
+	w.current.Close()
+	w.current = nil
+	w.processed[w.path] = true
+	delete(w.complete, w.path)
+	w.save()
+
+	path := filepath.Join(w.dir, w.path)
+	var err error
+	switch w.after {
+	case "keep":
+	case "delete":
+		err = os.Remove(path)
+	default:
+		err = os.Rename(path, filepath.Join(w.after, w.path))
+	}
+	if err != nil {
+		log.Println("Cannot", w.after, "processed file:", err)
+	}
+}
+
+// save writes the checkpoint file.  Files that are no longer in the directory are forgotten, so
+// a file that arrives again under the same name is read again.
+func (w *Watcher) save() {
+	var progress watchProgress
+	for name := range w.processed {
+		if _, err := os.Stat(filepath.Join(w.dir, name)); err == nil {
+			progress.Processed = append(progress.Processed, name)
+		} else {
+			delete(w.processed, name)
+		}
+	}
+	sort.Strings(progress.Processed)
+	if w.current != nil {
+		progress.Current, progress.Packets = w.path, w.packets
+	}
+	raw, err := json.Marshal(progress)
+	if err == nil {
+		// Replace the checkpoint atomically so that a crash never leaves half of it.
+		tmp := w.checkpoint + ".tmp"
+		if err = os.WriteFile(tmp, raw, 0644); err == nil {
+			err = os.Rename(tmp, w.checkpoint)
+		}
+	}
+	if err != nil {
+		log.Println("Cannot save checkpoint:", err)
+	}
+	w.saved = time.Now()
+}
+
+// LinkType returns the link type of the first file, or Ethernet until it is opened.
+func (w *Watcher) LinkType() layers.LinkType {
+	return w.first
+}
+
+// Interface returns an interface of the current file and its link type.
+func (w *Watcher) Interface(id int) (Interface, layers.LinkType) {
+	if interfaces, ok := w.current.(interfaceSource); ok {
+		return interfaces.Interface(id)
+	}
+	return Interface{ID: uint32(id)}, w.linkType
+}
+
+// SetBPFFilter filters the packets of the current file and every file after it.  Before the
+// first file, the filter is checked against the link type LinkType expects.
+func (w *Watcher) SetBPFFilter(expr string) error {
+	if w.current != nil {
+		if err := w.current.SetBPFFilter(expr); err != nil {
+			return err
+		}
+	} else if _, err := pcap.NewBPF(w.first, config.SnapLen, expr); err != nil {
+		return err
+	}
+	w.bpf = expr
+	return nil
+}
+
+// Close stops watching the directory, closes the current file, and saves how far we got in it.
+func (w *Watcher) Close() {
+	if w.unwatch != nil {
+		w.unwatch()
+		w.unwatch = nil
+	}
+	w.save()
+	if w.current != nil {
+		w.current.Close()
+		w.current = nil
+	}
+}
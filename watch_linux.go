@@ -0,0 +1,72 @@
+// This source code is covered by the license found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchClosed reports the names of files in a directory that are closed after writing or moved
+// into it.  unwatch removes the inotify watch, which wakes the reader up with IN_IGNORED so that
+// it closes the inotify file descriptor and names.
+func watchClosed(dir string) (names <-chan string, unwatch func(), err error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, nil, err
+	}
+	wd, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+	out := make(chan string, 1024)
+	stop := make(chan struct{})
+	var mu sync.Mutex // Guards fd, which is -1 once closed
+	go func() {
+		defer close(out)
+		defer func() {
+			mu.Lock()
+			syscall.Close(fd)
+			fd = -1
+			mu.Unlock()
+		}()
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := syscall.Read(fd, buf) // Only this goroutine closes fd
+			if err == syscall.EINTR {
+				continue
+			} else if err != nil || n <= 0 {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				offset += syscall.SizeofInotifyEvent
+				if event.Mask&syscall.IN_IGNORED != 0 {
+					// The watch was removed, or the directory is gone.
+					return
+				}
+				name := buf[offset : offset+int(event.Len)] // Padded with NULs
+				select {
+				case out <- strings.TrimRight(string(name), "\x00"):
+				case <-stop:
+					return
+				}
+				offset += int(event.Len)
+			}
+		}
+	}()
+	unwatch = func() {
+		mu.Lock()
+		if fd >= 0 {
+			syscall.InotifyRmWatch(fd, uint32(wd))
+		}
+		mu.Unlock()
+		close(stop)
+	}
+	return out, unwatch, nil
+}
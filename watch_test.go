@@ -0,0 +1,153 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Testing
+
+// spool copies the rotated test captures into a new spool directory, with modification times
+// old enough for the files to count as complete.
+func spool(t *testing.T) string {
+	dir := t.TempDir()
+	old := time.Now().Add(-2 * watchSettle)
+	for i, name := range []string{"capture-b.pcap", "capture-a.pcap"} {
+		raw, err := os.ReadFile(filepath.Join("testdata/rotated", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err = os.WriteFile(path, raw, 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := old.Add(time.Duration(i) * time.Second)
+		if err = os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readUntilNoFiles returns the seconds of the packets a Watcher reads until it runs out of files.
+// Files only count as complete once a second scan finds them unchanged, so it waits a few scans
+// for the first packet.
+func readUntilNoFiles(t *testing.T, w *Watcher, max int) []int64 {
+	var seconds []int64
+	for scans := 0; len(seconds) < max; {
+		_, ci, err := w.ZeroCopyReadPacketData()
+		if err == errNoPacket {
+			if scans++; len(seconds) > 0 || scans == 3 {
+				break
+			}
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		seconds = append(seconds, ci.Timestamp.Unix()-1546300800)
+	}
+	return seconds
+}
+
+func TestWatcher(t *testing.T) {
+	dir := spool(t)
+	done := t.TempDir()
+	w, err := NewWatcher(dir, "", done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stop in the middle of the second file, as if we were shut down.
+	if got, want := readUntilNoFiles(t, w, 4), []int64{0, 10, 20, 60}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got packets at %v seconds, want %v", got, want)
+	}
+	w.Close()
+	if _, err = os.Stat(filepath.Join(done, "capture-b.pcap")); err != nil {
+		t.Errorf("first file not moved: %v", err)
+	}
+	var progress watchProgress
+	raw, _ := os.ReadFile(filepath.Join(dir, ".ing-checkpoint"))
+	if err = json.Unmarshal(raw, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if want := (watchProgress{Current: "capture-a.pcap", Packets: 1}); !reflect.DeepEqual(progress, want) {
+		t.Errorf("got checkpoint %+v, want %+v", progress, want)
+	}
+
+	// A new Watcher resumes after the last packet we read.
+	if w, err = NewWatcher(dir, "", "keep"); err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got, want := readUntilNoFiles(t, w, 10), []int64{70, 80}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after restart got packets at %v seconds, want %v", got, want)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "capture-a.pcap")); err != nil {
+		t.Errorf("kept file is gone: %v", err)
+	}
+}
+
+func TestWatcherCheckpoints(t *testing.T) {
+	// A Watcher doesn't wait for files before it is read.
+	dir := t.TempDir()
+	start := time.Now()
+	w, err := NewWatcher(dir, "", "keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= watchInterval {
+		t.Errorf("NewWatcher took %v on an empty directory", elapsed)
+	}
+	if err = w.SetBPFFilter("udp"); err != nil {
+		t.Errorf("SetBPFFilter before the first file: %v", err)
+	}
+	w.Close()
+
+	// A checkpoint is saved while reading a file, not just at its end.
+	dir = spool(t)
+	if w, err = NewWatcher(dir, "", "keep"); err != nil {
+		t.Fatal(err)
+	}
+	readUntilNoFiles(t, w, 1)
+	w.saved = time.Now().Add(-watchCheckpointInterval)
+	readUntilNoFiles(t, w, 1)
+	var progress watchProgress
+	raw, _ := os.ReadFile(filepath.Join(dir, ".ing-checkpoint"))
+	if err = json.Unmarshal(raw, &progress); err != nil {
+		t.Fatal(err)
+	}
+	if want := (watchProgress{Current: "capture-b.pcap", Packets: 2}); !reflect.DeepEqual(progress, want) {
+		t.Errorf("got checkpoint %+v, want %+v", progress, want)
+	}
+
+	// Closing the Watcher stops inotify.
+	closed := w.closed
+	w.Close()
+	deadline := time.After(time.Second)
+	for open := closed != nil; open; {
+		select {
+		case _, open = <-closed:
+		case <-deadline:
+			t.Error("inotify still running after Close")
+			open = false
+		}
+	}
+}
+
+func TestNewWatcherErrors(t *testing.T) {
+	dir := spool(t)
+	for _, test := range []struct{ dir, after string }{
+		{filepath.Join(dir, "missing"), "keep"},
+		{filepath.Join(dir, "capture-a.pcap"), "keep"},
+		{dir, filepath.Join(dir, "missing")},
+	} {
+		if _, err := NewWatcher(test.dir, "", test.after); err == nil {
+			t.Errorf("NewWatcher(%q, %q) succeeded", test.dir, test.after)
+		}
+	}
+}
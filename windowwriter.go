@@ -0,0 +1,81 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// maxWindowFiles is the number of window files a WindowWriter keeps open.  A record for an older
+// window reopens its file.
+const maxWindowFiles = 4
+
+// WindowWriter writes records to one file per fixed time window, named with the UTC start of the
+// window, e.g. flow-ing-2019-03-01T10-00-00.json for the ten minute window starting at 10:00.
+// Windows are aligned to midnight UTC, so files from any run over the same traffic line up, and
+// should divide a day evenly.
+// Records arrive somewhat out of order, e.g. a flow that ends with an idle timeout is written
+// minutes after its last packet, so recent files are kept open and older ones are appended to.
+type WindowWriter struct {
+	prefix string // Path and name of files up to the window start
+	ext    string
+	window time.Duration
+	files  map[time.Time]*os.File
+	recent []time.Time // Starts of the open windows, least recently written first
+}
+
+// NewWindowWriter returns a writer of files named prefix-<window start>ext.
+func NewWindowWriter(prefix, ext string, window time.Duration) *WindowWriter {
+	return &WindowWriter{prefix: prefix, ext: ext, window: window,
+		files: make(map[time.Time]*os.File)}
+}
+
+// Write appends a record to the file of the window that t falls in.
+func (ww *WindowWriter) Write(t time.Time, b []byte) error {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	start := midnight.Add(t.Sub(midnight).Truncate(ww.window))
+	file, ok := ww.files[start]
+	if !ok {
+		if len(ww.recent) >= maxWindowFiles {
+			ww.files[ww.recent[0]].Close()
+			delete(ww.files, ww.recent[0])
+			ww.recent = ww.recent[1:]
+		}
+		var err error
+		file, err = os.OpenFile(ww.Filename(start), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		ww.files[start] = file
+	} else {
+		for i, s := range ww.recent {
+			if s.Equal(start) {
+				ww.recent = append(ww.recent[:i], ww.recent[i+1:]...)
+				break
+			}
+		}
+	}
+	ww.recent = append(ww.recent, start)
+	_, err := file.Write(b)
+	return err
+}
+
+// Filename returns the name of the file of the window starting at start.
+func (ww *WindowWriter) Filename(start time.Time) string {
+	return ww.prefix + "-" + start.UTC().Format("2006-01-02T15-04-05") + ww.ext
+}
+
+// Close closes all open files.
+func (ww *WindowWriter) Close() error {
+	var err error
+	for start, file := range ww.files {
+		if e := file.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(ww.files, start)
+	}
+	ww.recent = nil
+	return err
+}
@@ -0,0 +1,80 @@
+// This source code is covered by the license found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Testing
+
+func TestWindowWriter(t *testing.T) {
+	dir := t.TempDir()
+	ww := NewWindowWriter(filepath.Join(dir, "flow-ing"), ".json", 10*time.Minute)
+	chicago, _ := time.LoadLocation("America/Chicago")
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []struct {
+		minutes int
+		record  string
+	}{
+		{1, "a"}, {12, "b"}, {9, "c"}, {25, "d"}, {35, "e"}, {45, "f"}, {55, "g"}, {3, "h"},
+	}
+	for _, r := range records {
+		at := start.Add(time.Duration(r.minutes) * time.Minute).In(chicago)
+		if err := ww.Write(at, []byte(r.record)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ww.files) > maxWindowFiles {
+		t.Errorf("%d files open, want at most %d", len(ww.files), maxWindowFiles)
+	}
+	if err := ww.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"flow-ing-2019-01-01T00-00-00.json": "ach",
+		"flow-ing-2019-01-01T00-10-00.json": "b",
+		"flow-ing-2019-01-01T00-20-00.json": "d",
+		"flow-ing-2019-01-01T00-30-00.json": "e",
+		"flow-ing-2019-01-01T00-40-00.json": "f",
+		"flow-ing-2019-01-01T00-50-00.json": "g",
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != len(want) {
+		t.Errorf("got %d files, want %d", len(entries), len(want))
+	}
+	for name, contents := range want {
+		raw, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || string(raw) != contents {
+			t.Errorf("%s: got %q, %v; want %q", name, raw, err, contents)
+		}
+	}
+}
+
+func TestWindowWriterMidnight(t *testing.T) {
+	// Even windows that don't divide a day start over at midnight.
+	ww := NewWindowWriter("flow-ing", ".json", 7*time.Minute)
+	for _, test := range []struct {
+		at, start time.Time
+	}{
+		{time.Date(2019, 3, 1, 0, 3, 0, 0, time.UTC), time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2019, 3, 1, 0, 10, 0, 0, time.UTC), time.Date(2019, 3, 1, 0, 7, 0, 0, time.UTC)},
+		{time.Date(2019, 3, 1, 23, 59, 0, 0, time.UTC), time.Date(2019, 3, 1, 23, 55, 0, 0, time.UTC)},
+	} {
+		t.Run(test.at.Format("15:04"), func(t *testing.T) {
+			dir := t.TempDir()
+			ww.prefix = filepath.Join(dir, "flow-ing")
+			if err := ww.Write(test.at, []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+			ww.Close()
+			if _, err := os.Stat(ww.Filename(test.start)); err != nil {
+				t.Errorf("no file for the window starting at %s: %v", test.start.Format("15:04"), err)
+			}
+		})
+	}
+}